@@ -3,20 +3,21 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"log"
 	"math/big"
 	"time"
 
-	"github.com/hectorchu/gonano/pow"
 	"github.com/hectorchu/gonano/rpc"
 	"github.com/hectorchu/gonano/util"
-	"github.com/hectorchu/gonano/wallet"
 	"github.com/hectorchu/gonano/wallet/ed25519"
 	"github.com/hectorchu/gonano/websocket"
+	"golang.org/x/crypto/blake2b"
 )
 
-func validateBlock(block *rpc.Block, account string, amount *big.Int) (hash rpc.BlockHash, err error) {
+func validateBlock(ctx context.Context, block *rpc.Block, account string, amount *big.Int) (hash rpc.BlockHash, err error) {
 	if block.Type != "state" {
 		return nil, errors.New("invalid block type")
 	}
@@ -27,18 +28,31 @@ func validateBlock(block *rpc.Block, account string, amount *big.Int) (hash rpc.
 	if destAccount != account {
 		return nil, errors.New("incorrect destination account")
 	}
-	client := rpc.Client{URL: *rpcURL}
-	ai, err := client.AccountInfo(block.Account)
+	client := stickyClient(ctx, block.Account)
+	ai, err := accountInfoConfirmed(client, block.Account)
 	if err != nil {
 		return
 	}
-	if !bytes.Equal(block.Previous, ai.Frontier) {
+	frontier, balance := ai.Frontier, ai.Balance
+	if *strict {
+		if ai.BlockCount > ai.ConfirmationHeight {
+			return nil, &blockError{"unconfirmed_blocks", "account has unconfirmed blocks above its confirmation height"}
+		}
+		frontier, balance = ai.ConfirmedFrontier, ai.ConfirmedBalance
+		if frontier == nil || balance == nil {
+			return nil, &blockError{"unconfirmed_frontier", "node did not report a confirmed frontier for account"}
+		}
+	}
+	if !bytes.Equal(block.Previous, frontier) {
+		if *strict {
+			return nil, &blockError{"previous_not_confirmed_frontier", "previous block is not the confirmed frontier"}
+		}
 		return nil, errors.New("previous block is not frontier")
 	}
-	if block.Balance.Cmp(&ai.Balance.Int) >= 0 {
+	if block.Balance.Cmp(&balance.Int) >= 0 {
 		return nil, errors.New("invalid block balance for send")
 	}
-	sendAmount := new(big.Int).Sub(&ai.Balance.Int, &block.Balance.Int)
+	sendAmount := new(big.Int).Sub(&balance.Int, &block.Balance.Int)
 	if sendAmount.Cmp(amount) != 0 {
 		return nil, errors.New("incorrect payment amount")
 	}
@@ -55,81 +69,190 @@ func validateBlock(block *rpc.Block, account string, amount *big.Int) (hash rpc.
 	return
 }
 
-func sendBlock(block *rpc.Block) (err error) {
-	if err = generatePoW(block); err != nil {
+type blockError struct{ code, message string }
+
+func (e *blockError) Error() string {
+	return e.code + ": " + e.message
+}
+
+type forkError struct{ winner rpc.BlockHash }
+
+func (e *forkError) Error() string {
+	if e.winner == nil {
+		return "fork: block was not confirmed"
+	}
+	return "fork: block " + e.winner.String() + " was confirmed instead"
+}
+
+// waitConfirmation waits until the block, a send or a receive (including an
+// open) by subtype, is confirmed, or a fork of it is. Node errors are logged
+// and retried, so it only fails with a forkError or when ctx is done.
+func waitConfirmation(ctx context.Context, block *rpc.Block, hash rpc.BlockHash, subtype string) (err error) {
+	root, base := block.Previous, sendDifficulty
+	if subtype != "send" {
+		subtype, base = "receive", receiveDifficulty
+		if bytes.Equal(root, make([]byte, 32)) {
+			if root, err = util.AddressToPubkey(block.Account); err != nil {
+				return
+			}
+		}
+	}
+	published, multiplier := time.Now(), networkMultiplier()
+	for {
+		client := stickyClient(ctx, block.Account)
+		if time.Since(published) > *powStall {
+			multiplier *= 2
+			difficulty := scaleDifficulty(networkMinimum(base), multiplier)
+			if block.Work, err = generateWork(ctx, root, difficulty, priorityForward); err != nil {
+				log.Print(err)
+			} else if _, err = client.Process(block, subtype); err != nil && err.Error() != "Old block" && err.Error() != "Fork" {
+				log.Print(err)
+			}
+			published = time.Now()
+		}
+		if confirmed, err := checkConfirmation(client, block, hash); confirmed {
+			return nil
+		} else if _, ok := err.(*forkError); ok {
+			return err
+		} else if err != nil {
+			log.Print(err)
+		}
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func checkConfirmation(client *rpc.Client, block *rpc.Block, hash rpc.BlockHash) (confirmed bool, err error) {
+	bi, err := client.BlockInfo(hash)
+	if err == nil && bi.Confirmed {
+		return true, nil
+	} else if err != nil && err.Error() != "Block not found" {
 		return
 	}
-	client := rpc.Client{URL: *rpcURL}
+	ai, err := client.AccountInfo(block.Account)
+	if err != nil {
+		if err.Error() == "Account not found" {
+			err = nil
+		}
+		return
+	}
+	if bytes.Equal(block.Previous, make([]byte, 32)) {
+		// An open block has no previous block to find successors of; it
+		// lost if the account was opened by another block.
+		if ai.ConfirmationHeight == 0 || bytes.Equal(ai.OpenBlock, hash) {
+			return
+		}
+		return false, &forkError{ai.OpenBlock}
+	}
+	prev, err := client.BlockInfo(block.Previous)
+	if err != nil || ai.ConfirmationHeight <= prev.Height {
+		return
+	}
+	successors, err := client.Successors(block.Previous, 2)
+	if err != nil {
+		return
+	}
+	var winner rpc.BlockHash
+	if len(successors) > 1 {
+		if winner = successors[1]; bytes.Equal(winner, hash) {
+			return true, nil
+		}
+	}
+	return false, &forkError{winner}
+}
+
+// confirmBlock republishes a block of an intermediate account until it is
+// confirmed, for at most an hour.
+func confirmBlock(address string, hash rpc.BlockHash) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	client := stickyClient(ctx, address)
+	bi, err := client.BlockInfo(hash)
+	if err == nil {
+		err = waitConfirmation(ctx, bi.Contents, hash, bi.Subtype)
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func forward(a *Account, account string, amount *big.Int) (hash rpc.BlockHash, err error) {
+	if hash, err = a.Send(account, amount); err == nil {
+		go confirmBlock(a.Address(), hash)
+	}
+	return
+}
+
+func sendBlock(ctx context.Context, block *rpc.Block) (err error) {
+	if !validateWork(block.Previous, block.Work, currentDifficulty(sendDifficulty)) {
+		if err = generatePoW(ctx, block); err != nil {
+			return
+		}
+	}
+	client := stickyClient(ctx, block.Account)
 	_, err = client.Process(block, "send")
 	return
 }
 
 func waitReceive(
-	ctx context.Context, ws *wsMux, a *wallet.Account,
-	account string, amount *big.Int, timeout time.Duration,
+	ctx context.Context, det detector, id string, a *Account,
+	account string, amount *big.Int,
 ) (hash rpc.BlockHash, err error) {
-	ctx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-	msg, err := ws.connect(a.Address())
+	sub, err := det.connect(a.Address())
 	if err != nil {
 		return
 	}
-	defer ws.disconnect(a.Address())
-	if err = a.ReceivePendings(); err != nil {
+	defer det.disconnect(sub)
+	client := stickyClient(ctx, a.Address())
+	if hash, err = settle(ctx, client, id, a, account, amount); hash != nil || err != nil {
 		return
 	}
-	client := rpc.Client{URL: *rpcURL, Ctx: ctx}
-	if ai, err := client.AccountInfo(a.Address()); err == nil {
-		if excess := new(big.Int).Sub(&ai.Balance.Int, amount); excess.Sign() >= 0 {
-			if excess.Sign() > 0 {
-				for hash := ai.Frontier; ; {
-					bi, err := client.BlockInfo(hash)
-					if err != nil {
-						return nil, err
-					}
-					if bi.Subtype == "receive" {
-						if bi, err = client.BlockInfo(bi.Contents.Link); err != nil {
-							return nil, err
-						}
-						if _, err = a.Send(bi.BlockAccount, excess); err != nil {
-							return nil, err
-						}
-						break
-					}
-					hash = bi.Contents.Previous
-				}
-			}
-			return a.Send(account, amount)
-		}
-	} else if err.Error() != "Account not found" {
-		return nil, err
-	}
+	tick := time.NewTicker(30 * time.Second)
+	defer tick.Stop()
 	for {
 		select {
-		case m := <-msg:
+		case <-tick.C:
+			if err = checkWatch(id, a); err != nil {
+				return
+			}
+		case m := <-sub.C:
+			if err = checkWatch(id, a); err != nil {
+				return
+			}
 			switch m := m.(type) {
 			case *websocket.Confirmation:
 				switch a.Address() {
 				case m.Block.LinkAsAccount:
-					if _, err = a.ReceivePending(m.Hash); err != nil && err.Error() != "Unreceivable" {
+					if hash, err = receive(id, a, m.Hash, m.Account, m.Amount); err == nil {
+						works.precompute(hash, sendDifficulty)
+					} else if err.Error() != "Unreceivable" {
 						return
 					}
 				case m.Block.Account:
+					precomputeWork(a.Address(), m.Hash, &m.Block.Balance.Int)
 					if excess := new(big.Int).Sub(&m.Block.Balance.Int, amount); excess.Sign() >= 0 {
+						if err = waitQuorum(ctx, m.Hash); err != nil {
+							return
+						}
 						if excess.Sign() > 0 {
 							bi, err := client.BlockInfo(m.Block.Link)
 							if err != nil {
 								return nil, err
 							}
-							if _, err = a.Send(bi.BlockAccount, excess); err != nil {
+							if _, err = refundTo(id, a, bi.BlockAccount, excess); err != nil {
 								return nil, err
 							}
 						}
-						return a.Send(account, amount)
+						return forward(a, account, amount)
 					}
 				}
-			case error:
-				return nil, m
+			case subscriptionOverflow:
+				if hash, err = settle(ctx, client, id, a, account, amount); hash != nil || err != nil {
+					return
+				}
 			}
 		case <-ctx.Done():
 			return nil, ctx.Err()
@@ -137,9 +260,55 @@ func waitReceive(
 	}
 }
 
-func refund(a *wallet.Account) (err error) {
-	client := rpc.Client{URL: *rpcURL}
-	if err = a.ReceivePendings(); err != nil {
+func settle(
+	ctx context.Context, client nodeBackend, id string, a *Account,
+	account string, amount *big.Int,
+) (hash rpc.BlockHash, err error) {
+	if err = checkWatch(id, a); err != nil {
+		return
+	}
+	if err = receivePendings(ctx, id, a); err != nil {
+		return
+	}
+	go precomputeAccountWork(a.Address())
+	ai, err := client.AccountInfo(a.Address())
+	if err != nil {
+		if err.Error() == "Account not found" {
+			err = nil
+		}
+		return
+	}
+	excess := new(big.Int).Sub(&ai.Balance.Int, amount)
+	if excess.Sign() < 0 {
+		return
+	}
+	if err = waitQuorum(ctx, ai.Frontier); err != nil {
+		return
+	}
+	if excess.Sign() > 0 {
+		for hash := ai.Frontier; ; {
+			bi, err := client.BlockInfo(hash)
+			if err != nil {
+				return nil, err
+			}
+			if bi.Subtype == "receive" || bi.Subtype == "open" {
+				if bi, err = client.BlockInfo(bi.Contents.Link); err != nil {
+					return nil, err
+				}
+				if _, err = refundTo(id, a, bi.BlockAccount, excess); err != nil {
+					return nil, err
+				}
+				break
+			}
+			hash = bi.Contents.Previous
+		}
+	}
+	return forward(a, account, amount)
+}
+
+func refund(ctx context.Context, id string, a *Account) (hashes []rpc.BlockHash, err error) {
+	client := stickyClient(ctx, a.Address())
+	if err = receivePendings(ctx, id, a); err != nil {
 		return
 	}
 	ai, err := client.AccountInfo(a.Address())
@@ -152,34 +321,99 @@ func refund(a *wallet.Account) (err error) {
 	for hash, balance := ai.Frontier, &ai.Balance.Int; balance.Sign() > 0; {
 		bi, err := client.BlockInfo(hash)
 		if err != nil {
-			return err
+			return hashes, err
 		}
-		if bi.Subtype == "receive" {
+		if bi.Subtype == "receive" || bi.Subtype == "open" {
 			bi, err := client.BlockInfo(bi.Contents.Link)
 			if err != nil {
-				return err
+				return hashes, err
 			}
 			amount := &bi.Amount.Int
 			if amount.Cmp(balance) > 0 {
 				amount = balance
 			}
-			if _, err = a.Send(bi.BlockAccount, amount); err != nil {
-				return err
+			refund, err := refundTo(id, a, bi.BlockAccount, amount)
+			if err != nil {
+				return hashes, err
 			}
+			hashes = append(hashes, refund)
 			balance.Sub(balance, amount)
 		}
 		hash = bi.Contents.Previous
 	}
+	go precomputeAccountWork(a.Address())
+	return
+}
+
+// receivePendings pockets all pending amounts, recording each receive as an
+// event of payment id.
+func receivePendings(ctx context.Context, id string, a *Account) (err error) {
+	client := stickyClient(ctx, a.Address())
+	pendings, err := client.AccountsPending([]string{a.Address()}, -1)
+	if err != nil {
+		return
+	}
+	for hash, pending := range pendings[a.Address()] {
+		link, err := hex.DecodeString(hash)
+		if err != nil {
+			return err
+		}
+		if _, err = receive(id, a, link, pending.Source, pending.Amount); err != nil {
+			return err
+		}
+	}
 	return
 }
 
-func generatePoW(block *rpc.Block) (err error) {
-	difficulty, _ := hex.DecodeString("fffffff800000000")
-	if *powURL != "" {
-		client := rpc.Client{URL: *powURL}
-		block.Work, _, _, err = client.WorkGenerate(block.Previous, difficulty)
-	} else {
-		block.Work, err = pow.Generate(block.Previous, difficulty)
+func receive(id string, a *Account, link rpc.BlockHash, source string, amount *rpc.RawAmount) (hash rpc.BlockHash, err error) {
+	if hash, err = a.ReceivePending(link); err != nil {
+		return
 	}
+	go confirmBlock(a.Address(), hash)
+	e := &paymentEvent{id: id, typ: "received", hash: hash, account: source}
+	var j *journalEntry
+	if amount != nil {
+		e.amount = &amount.Int
+		j = &journalEntry{id: id, kind: "receive", hash: hash, debit: a.Address(), credit: source, amount: e.amount}
+	}
+	logEvent(e, j)
+	return
+}
+
+func refundTo(id string, a *Account, account string, amount *big.Int) (hash rpc.BlockHash, err error) {
+	if hash, err = a.Send(account, amount); err == nil {
+		go confirmBlock(a.Address(), hash)
+		logEvent(&paymentEvent{id: id, typ: "refunded", hash: hash, account: account, amount: amount},
+			&journalEntry{id: id, kind: "refund", hash: hash, debit: account, credit: a.Address(), amount: amount})
+	}
+	return
+}
+
+// logEvent records an event, with the journal entry for any funds it moved,
+// which accompanies a change on the ledger rather than in storage. The
+// change cannot be undone, so failure is only logged.
+func logEvent(e *paymentEvent, j *journalEntry) {
+	if err := store.addEvent(e, j); err != nil {
+		log.Print(err)
+	}
+}
+
+func validateWork(root rpc.BlockHash, work rpc.HexData, difficulty []byte) bool {
+	if len(work) != 8 {
+		return false
+	}
+	h, err := blake2b.New(8, nil)
+	if err != nil {
+		return false
+	}
+	for i := len(work) - 1; i >= 0; i-- {
+		h.Write(work[i : i+1])
+	}
+	h.Write(root)
+	return binary.LittleEndian.Uint64(h.Sum(nil)) >= binary.BigEndian.Uint64(difficulty)
+}
+
+func generatePoW(ctx context.Context, block *rpc.Block) (err error) {
+	block.Work, err = generateWork(ctx, block.Previous, currentDifficulty(sendDifficulty), priorityHandoff)
 	return
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// callbackClient bounds each delivery attempt, so that a callback URL which
+// hangs holds up nothing but its own callbacks.
+var callbackClient = &http.Client{Timeout: 10 * time.Second}
+
+// postCallback records a callback and delivers it in the background. A
+// callback which is not accepted stays recorded and is retried by the
+// scavenger, so postCallback fails only if it could not be recorded.
+func postCallback(v map[string]string) (err error) {
+	if *callbackURL == "" {
+		return
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	seq, err := store.addCallback(v["id"], body)
+	if err != nil {
+		go func() {
+			if err := sendCallback(body); err != nil {
+				log.Printf("payment %s: callback: %v", v["id"], err)
+			}
+		}()
+		return
+	}
+	go deliverCallback(pendingCallback{seq: seq, id: v["id"], body: body})
+	return
+}
+
+func deliverCallback(c pendingCallback) {
+	err := sendCallback(c.body)
+	if err == nil {
+		err = store.deleteCallback(c.seq)
+	} else {
+		log.Printf("payment %s: callback attempt %d: %v", c.id, c.attempts+1, err)
+		err = store.retryCallback(c.seq)
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func sendCallback(body []byte) (err error) {
+	resp, err := callbackClient.Post(*callbackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("callback URL returned %s", resp.Status)
+	}
+	return
+}
+
+// retryCallbacks delivers recorded callbacks again, backing off from a minute
+// after the first attempt to an hour between attempts.
+func retryCallbacks() {
+	if *callbackURL == "" {
+		return
+	}
+	callbacks, err := store.getCallbacks()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, c := range callbacks {
+		backoff := time.Minute
+		if c.attempts > 6 {
+			backoff = time.Hour
+		} else if c.attempts > 1 {
+			backoff <<= c.attempts - 1
+		}
+		if time.Since(c.time) >= backoff {
+			deliverCallback(c)
+		}
+	}
+}
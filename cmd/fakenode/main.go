@@ -0,0 +1,47 @@
+// Command fakenode serves an in-memory Nano ledger over the node RPC and
+// websocket protocols, for running the payment server without a network.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/hectorchu/nano-payment-server/fakenode"
+)
+
+func main() {
+	var (
+		rpcAddr          = flag.String("rpc", "[::1]:7076", "RPC listen address")
+		wsAddr           = flag.String("ws", "[::1]:7078", "WebSocket listen address")
+		seed             = flag.String("seed", "", "Hex seed of the genesis account (default all zeros)")
+		confirmDelay     = flag.Duration("confirm-delay", 0, "Delay before a processed block is confirmed")
+		sendThreshold    = flag.String("send-threshold", "ffff000000000000", "Work threshold for send and change blocks")
+		receiveThreshold = flag.String("receive-threshold", "fff0000000000000", "Work threshold for receive and open blocks")
+	)
+	flag.Parse()
+	s := make([]byte, 32)
+	if *seed != "" {
+		var err error
+		if s, err = hex.DecodeString(*seed); err != nil {
+			log.Fatal(err)
+		}
+	}
+	n, err := fakenode.New(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	n.ConfirmDelay = *confirmDelay
+	if n.SendThreshold, err = strconv.ParseUint(*sendThreshold, 16, 64); err != nil {
+		log.Fatal(err)
+	}
+	if n.ReceiveThreshold, err = strconv.ParseUint(*receiveThreshold, 16, 64); err != nil {
+		log.Fatal(err)
+	}
+	genesis, _ := fakenode.Address(n.Genesis())
+	log.Printf("genesis account %s", genesis)
+	go func() { log.Fatal(http.ListenAndServe(*wsAddr, n)) }()
+	log.Fatal(http.ListenAndServe(*rpcAddr, n))
+}
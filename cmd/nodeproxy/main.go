@@ -0,0 +1,178 @@
+// Command nodeproxy sits between the payment server and a node and injects
+// faults described by a scenario file: RPC latency and error responses,
+// dropped and duplicated websocket messages, and connection resets.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	rpcAddr      = flag.String("rpc", "[::1]:7176", "RPC listen address")
+	wsAddr       = flag.String("ws", "[::1]:7178", "WebSocket listen address")
+	nodeRPC      = flag.String("node-rpc", "http://[::1]:7076", "Upstream node RPC URL")
+	nodeWS       = flag.String("node-ws", "ws://[::1]:7078", "Upstream node WebSocket URL")
+	scenarioPath = flag.String("scenario", "", "Path to the JSON scenario file")
+	seed         = flag.Int64("seed", 0, "Random seed for probabilistic faults (default time-based)")
+)
+
+var (
+	faults   *scenario
+	upgrader = websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+)
+
+func main() {
+	flag.Parse()
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	rand.Seed(*seed)
+	var err error
+	if faults, err = loadScenario(*scenarioPath); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("loaded %d rules, seed %d", len(faults.rules), *seed)
+	go func() { log.Fatal(http.ListenAndServe(*wsAddr, http.HandlerFunc(wsHandler))) }()
+	log.Fatal(http.ListenAndServe(*rpcAddr, http.HandlerFunc(rpcHandler)))
+}
+
+func reset(w http.ResponseWriter) {
+	if h, ok := w.(http.Hijacker); ok {
+		if c, _, err := h.Hijack(); err == nil {
+			c.Close()
+			return
+		}
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func rpcHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	var v struct{ Action string }
+	json.Unmarshal(body, &v)
+	var (
+		resp      []byte
+		forwarded bool
+	)
+	for _, rule := range faults.match("rpc", v.Action, body) {
+		if rule.Delay.Duration > 0 {
+			log.Printf("rpc %s: delaying %s", v.Action, rule.Delay)
+			time.Sleep(rule.Delay.Duration)
+		}
+		if rule.Forward && !forwarded {
+			if resp, err = forward(r, body); err != nil {
+				log.Print(err)
+			}
+			forwarded = true
+		}
+		if rule.Reset {
+			log.Printf("rpc %s: resetting connection", v.Action)
+			reset(w)
+			return
+		}
+		if rule.Error != "" {
+			log.Printf("rpc %s: responding with error %q", v.Action, rule.Error)
+			json.NewEncoder(w).Encode(map[string]string{"error": rule.Error})
+			return
+		}
+	}
+	if !forwarded {
+		if resp, err = forward(r, body); err != nil {
+			log.Print(err)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+func forward(r *http.Request, body []byte) (resp []byte, err error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, *nodeRPC, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	upstream, _, err := websocket.DefaultDialer.DialContext(r.Context(), *nodeWS, nil)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	go func() {
+		defer upstream.Close()
+		for {
+			t, m, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = upstream.WriteMessage(t, m); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		t, m, err := upstream.ReadMessage()
+		if err != nil {
+			return
+		}
+		var v struct{ Topic string }
+		json.Unmarshal(m, &v)
+		copies := 1
+		for _, rule := range faults.match("ws", v.Topic, m) {
+			if rule.Delay.Duration > 0 {
+				log.Printf("ws %s: delaying %s", v.Topic, rule.Delay)
+				time.Sleep(rule.Delay.Duration)
+			}
+			if rule.Reset {
+				log.Printf("ws %s: resetting connection", v.Topic)
+				return
+			}
+			if rule.Drop {
+				log.Printf("ws %s: dropping message", v.Topic)
+				copies = 0
+			}
+			if rule.Duplicate && copies > 0 {
+				log.Printf("ws %s: duplicating message", v.Topic)
+				copies++
+			}
+		}
+		for i := 0; i < copies; i++ {
+			if err = c.WriteMessage(t, m); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// rule is one fault in a scenario. A rule applies to RPC requests when
+// target is "rpc" and to websocket messages from the node when target is
+// "ws". Action matches the RPC action or the websocket topic, and Match a
+// substring of the raw request or message.
+type rule struct {
+	Target      string
+	Action      string
+	Match       string
+	After       duration
+	Until       duration
+	Skip        int
+	Count       int
+	Probability float64
+	Delay       duration
+	Error       string
+	Forward     bool
+	Reset       bool
+	Drop        bool
+	Duplicate   bool
+
+	seen, fired int
+}
+
+type duration struct{ time.Duration }
+
+func (d *duration) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(data, &s); err != nil {
+		return
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return
+}
+
+type scenario struct {
+	m     sync.Mutex
+	start time.Time
+	rules []*rule
+}
+
+func loadScenario(path string) (s *scenario, err error) {
+	s = &scenario{start: time.Now()}
+	if path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &s.rules)
+	return
+}
+
+// match returns the rules which fire for an event. action is the RPC
+// action or the websocket topic, body the raw request or message.
+func (s *scenario) match(target, action string, body []byte) (rules []*rule) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	elapsed := time.Since(s.start)
+	for _, r := range s.rules {
+		if r.Target != target ||
+			r.Action != "" && r.Action != action ||
+			r.Match != "" && !bytes.Contains(body, []byte(r.Match)) ||
+			elapsed < r.After.Duration ||
+			r.Until.Duration > 0 && elapsed >= r.Until.Duration {
+			continue
+		}
+		if r.seen++; r.seen <= r.Skip {
+			continue
+		}
+		if r.Count > 0 && r.fired >= r.Count {
+			continue
+		}
+		if r.Probability > 0 && rand.Float64() >= r.Probability {
+			continue
+		}
+		r.fired++
+		rules = append(rules, r)
+	}
+	return
+}
@@ -0,0 +1,29 @@
+// Command nodereplay serves a recording made with the payment server's
+// -record flag over the node RPC and websocket protocols.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/hectorchu/nano-payment-server/recording"
+)
+
+func main() {
+	var (
+		rpcAddr = flag.String("rpc", "[::1]:7076", "RPC listen address")
+		wsAddr  = flag.String("ws", "[::1]:7078", "WebSocket listen address")
+		path    = flag.String("f", "", "Path to the recording")
+		maxWait = flag.Duration("max-wait", 5*time.Second, "Longest a websocket message waits for the RPC exchanges recorded before it")
+	)
+	flag.Parse()
+	p, err := recording.Open(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.MaxWait = *maxWait
+	go func() { log.Fatal(http.ListenAndServe(*wsAddr, p)) }()
+	log.Fatal(http.ListenAndServe(*rpcAddr, p))
+}
@@ -0,0 +1,78 @@
+// Command paybench measures the throughput of /payment/new on a running
+// payment server.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func main() {
+	var (
+		url     = flag.String("url", "http://[::1]:7080", "Payment server URL")
+		account = flag.String("account", "nano_1111111111111111111111111111111111111111111111111111hifc8npp", "Merchant account to request payments to")
+		amount  = flag.String("amount", "1", "Amount of each payment in NANO")
+		n       = flag.Int("n", 2000, "Number of payments to create")
+		c       = flag.Int("c", 32, "Number of concurrent clients")
+	)
+	flag.Parse()
+	body, err := json.Marshal(map[string]string{"account": *account, "amount": *amount})
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: *c}}
+	var (
+		next      int64
+		failures  int64
+		m         sync.Mutex
+		latencies []time.Duration
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for i := 0; i < *c; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&next, 1) <= int64(*n) {
+				t := time.Now()
+				resp, err := client.Post(*url+"/payment/new", "application/json", bytes.NewReader(body))
+				if err != nil {
+					log.Print(err)
+					atomic.AddInt64(&failures, 1)
+					continue
+				}
+				data, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					log.Printf("%s: %s", resp.Status, bytes.TrimSpace(data))
+					atomic.AddInt64(&failures, 1)
+					continue
+				}
+				m.Lock()
+				latencies = append(latencies, time.Since(t))
+				m.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if len(latencies) == 0 {
+		log.Fatal("no successful requests")
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	pct := func(p float64) time.Duration { return latencies[int(p*float64(len(latencies)-1))] }
+	fmt.Printf("%d payments, %d failed, in %v\n", len(latencies), failures, elapsed.Round(time.Millisecond))
+	fmt.Printf("%.0f payments/s\n", float64(len(latencies))/elapsed.Seconds())
+	fmt.Printf("latency p50 %v  p95 %v  p99 %v  max %v\n",
+		pct(.5).Round(time.Microsecond), pct(.95).Round(time.Microsecond),
+		pct(.99).Round(time.Microsecond), latencies[len(latencies)-1].Round(time.Microsecond))
+}
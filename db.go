@@ -2,15 +2,13 @@ package main
 
 import (
 	"crypto/rand"
-	"database/sql"
 	"encoding/base64"
-	"encoding/hex"
-	"errors"
 	"math/big"
+	"strings"
+	"time"
 
 	"github.com/hectorchu/gonano/rpc"
 	"github.com/hectorchu/gonano/util"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 type paymentRecord struct {
@@ -18,110 +16,132 @@ type paymentRecord struct {
 	account string
 	amount  util.NanoAmount
 	hash    rpc.BlockHash
-}
-
-var db *sql.DB
+	handoff string
+	reason  string
 
-func initDB() (err error) {
-	db, err = sql.Open("sqlite3", *dbPath)
-	return
+	// state is "cancelled" or "expired" once the payment has been closed
+	// without completing, by closedBy ("api" or "scavenger").
+	state    string
+	closedBy string
+	refunds  []rpc.BlockHash
+	closedAt time.Time
 }
 
-func withDB(f func(*sql.Tx) error) (err error) {
-	tx, err := db.Begin()
-	if err != nil {
-		return
+func (p *paymentRecord) status() string {
+	switch {
+	case p.state != "":
+		return p.state
+	case p.handoff == "failed":
+		return "failed"
+	case p.handoff == "pending":
+		return "confirming"
+	case p.hash != nil:
+		return "completed"
 	}
-	if err = f(tx); err != nil {
-		tx.Rollback()
-		return
-	}
-	return tx.Commit()
+	return "pending"
 }
 
-func getConfig(key string) (value string, err error) {
-	err = withDB(func(tx *sql.Tx) (err error) {
-		value, err = getConfigWithTx(tx, key)
-		return
-	})
-	return
+type walletAllocation struct {
+	id    string
+	index uint32
+	time  time.Time
 }
 
-func getConfigWithTx(tx *sql.Tx, key string) (value string, err error) {
-	err = tx.QueryRow("SELECT value FROM config WHERE key = ?", key).Scan(&value)
-	return
+// paymentEvent is an entry in the append-only log of what happened to
+// payments. seq orders events and is never reused.
+type paymentEvent struct {
+	seq     int64
+	id      string
+	typ     string
+	time    time.Time
+	hash    rpc.BlockHash
+	account string
+	amount  *big.Int
+	reason  string
 }
 
-func setConfig(key, value string) (err error) {
-	return withDB(func(tx *sql.Tx) error {
-		return setConfigWithTx(tx, key, value)
-	})
+// journalEntry is one movement of funds on the ledger through an
+// intermediate account, debiting the receiving account and crediting the
+// sending one. kind is "receive" from the payer, "forward" to the merchant
+// or "refund" back to the payer.
+type journalEntry struct {
+	seq    int64
+	id     string
+	kind   string
+	hash   rpc.BlockHash
+	debit  string
+	credit string
+	amount *big.Int
+	time   time.Time
 }
 
-func setConfigWithTx(tx *sql.Tx, key, value string) (err error) {
-	if _, err = tx.Exec("CREATE TABLE IF NOT EXISTS config(key TEXT PRIMARY KEY, value TEXT)"); err != nil {
-		return
-	}
-	_, err = tx.Exec("REPLACE INTO config VALUES(?,?)", key, value)
-	return
+// pendingCallback is a callback which the callback URL has not accepted yet,
+// last attempted at time.
+type pendingCallback struct {
+	seq      int64
+	id       string
+	body     []byte
+	attempts int
+	time     time.Time
 }
 
-func newPaymentRequest(account string, amount *big.Int) (payment *paymentRecord, err error) {
-	id := make([]byte, 8)
-	if _, err = rand.Read(id); err != nil {
-		return
-	}
-	payment = &paymentRecord{
-		id:      base64.RawURLEncoding.EncodeToString(id),
-		account: account,
-		amount:  util.NanoAmount{Raw: amount},
-	}
-	err = withDB(func(tx *sql.Tx) (err error) {
-		if _, err = tx.Exec(`
-			CREATE TABLE IF NOT EXISTS
-			payments(id TEXT PRIMARY KEY, account TEXT, amount TEXT, block_hash TEXT)
-		`); err != nil {
-			return
-		}
-		_, err = tx.Exec("INSERT INTO payments VALUES(?,?,?,?)", payment.id, account, amount.String(), "")
-		return
-	})
-	return
-}
+type storage interface {
+	getConfig(key string) (string, error)
+	setConfig(key, value string) error
 
-func getPaymentRequest(id string) (payment *paymentRecord, err error) {
-	err = withDB(func(tx *sql.Tx) (err error) {
-		payment = &paymentRecord{id: id}
-		var amount, hash string
-		if err = tx.QueryRow(`
-			SELECT account, amount, block_hash FROM payments WHERE id = ?
-		`, id).Scan(&payment.account, &amount, &hash); err != nil {
-			return
-		}
-		var ok bool
-		if payment.amount.Raw, ok = new(big.Int).SetString(amount, 10); !ok {
-			return errors.New("could not decode amount")
-		}
-		if hash != "" {
-			if payment.hash, err = hex.DecodeString(hash); err != nil {
-				return
-			}
-		}
-		return
-	})
-	return
+	newPaymentRequest(account string, amount *big.Int) (*paymentRecord, error)
+	getPaymentRequest(id string) (*paymentRecord, error)
+	updatePaymentRequest(id, from string, hash rpc.BlockHash) error
+	closePaymentRequest(id, state, reason, closedBy string, refunds []rpc.BlockHash) error
+	addPaymentRefunds(id string, refunds []rpc.BlockHash) error
+	retirePaymentRequests(before time.Time, purge bool) (int64, error)
+
+	updatePaymentHandoff(id string, hash rpc.BlockHash, block *rpc.Block) error
+	confirmPaymentHandoff(id string) error
+	failPaymentHandoff(id, reason string) error
+	getPendingHandoffs() (map[string]string, error)
+	revertPaymentHandoff(id string) error
+
+	getFreeWalletIndex(id string, min uint32) (uint32, error)
+	getWalletIndex(id string) (uint32, error)
+	getWalletAllocation(id string) (walletAllocation, error)
+	getWalletAllocations() ([]walletAllocation, error)
+	getWalletIndexesOlderThan(t time.Time) ([]string, error)
+	freeWalletIndex(id string) error
+
+	getCachedWork(root rpc.BlockHash) (rpc.HexData, error)
+	setCachedWork(root rpc.BlockHash, work rpc.HexData) error
+	deleteCachedWork(root rpc.BlockHash) error
+	deleteCachedWorkOlderThan(t time.Time) error
+
+	addEvent(e *paymentEvent, j *journalEntry) error
+	getEvents(after int64, limit int) ([]paymentEvent, error)
+	getJournal(id string) ([]journalEntry, error)
+
+	addCallback(id string, body []byte) (int64, error)
+	getCallbacks() ([]pendingCallback, error)
+	retryCallback(seq int64) error
+	deleteCallback(seq int64) error
+
+	appliedMigrations() (map[int]time.Time, error)
+	migrate() ([]int, error)
 }
 
-func updatePaymentRequest(id string, hash rpc.BlockHash) (err error) {
-	return withDB(func(tx *sql.Tx) (err error) {
-		_, err = tx.Exec("UPDATE payments SET block_hash = ? WHERE id = ?", hash.String(), id)
-		return
-	})
+var store storage
+
+func initDB() (err error) {
+	if strings.HasPrefix(*dbPath, "postgres://") || strings.HasPrefix(*dbPath, "postgresql://") {
+		store, err = newSQLStore("postgres", *dbPath)
+	} else {
+		store, err = newSQLStore("sqlite3", *dbPath)
+	}
+	return
 }
 
-func deletePaymentRequest(id string) (err error) {
-	return withDB(func(tx *sql.Tx) (err error) {
-		_, err = tx.Exec("DELETE FROM payments WHERE id = ?", id)
+func newPaymentID() (id string, err error) {
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
 		return
-	})
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
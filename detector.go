@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+
+	"github.com/gorilla/websocket"
+	"github.com/hectorchu/gonano/rpc"
+	nanows "github.com/hectorchu/gonano/websocket"
+)
+
+type detector interface {
+	connect(account string) (*subscription, error)
+	disconnect(*subscription)
+}
+
+type subscription struct {
+	account string
+	C       <-chan interface{}
+	ch      chan interface{}
+}
+
+// subscriptionOverflow is sent to a subscriber whose buffer filled up.
+// Messages after it were dropped until the buffer drained.
+type subscriptionOverflow struct{}
+
+func newSubscription(account string) *subscription {
+	ch := make(chan interface{}, 32)
+	return &subscription{account: account, C: ch, ch: ch}
+}
+
+func (sub *subscription) send(m interface{}) {
+	switch len(sub.ch) {
+	case cap(sub.ch):
+	case cap(sub.ch) - 1:
+		sub.ch <- subscriptionOverflow{}
+	default:
+		sub.ch <- m
+	}
+}
+
+type subscriptions map[string]map[*subscription]bool
+
+func (s subscriptions) add(sub *subscription) (first bool) {
+	subs, ok := s[sub.account]
+	if !ok {
+		subs = make(map[*subscription]bool)
+		s[sub.account] = subs
+	}
+	subs[sub] = true
+	return !ok
+}
+
+func (s subscriptions) remove(sub *subscription) (last bool) {
+	subs := s[sub.account]
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(s, sub.account)
+		return true
+	}
+	return false
+}
+
+func (s subscriptions) accounts() (accounts []string) {
+	accounts = make([]string, 0, len(s))
+	for account := range s {
+		accounts = append(accounts, account)
+	}
+	return
+}
+
+func (s subscriptions) dispatch(m *nanows.Confirmation) {
+	for sub := range s[m.Block.Account] {
+		sub.send(m)
+	}
+	if m.Block.Account != m.Block.LinkAsAccount {
+		for sub := range s[m.Block.LinkAsAccount] {
+			sub.send(m)
+		}
+	}
+}
+
+func ledgerEvents(client nodeBackend, accounts []string) (events []*nanows.Confirmation, err error) {
+	pendings, err := client.AccountsPending(accounts, -1)
+	if err != nil {
+		return
+	}
+	for account, pendings := range pendings {
+		for hash, pending := range pendings {
+			link, err := hex.DecodeString(hash)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, &nanows.Confirmation{
+				Account: pending.Source,
+				Amount:  pending.Amount,
+				Hash:    link,
+				Block:   &rpc.Block{Account: pending.Source, LinkAsAccount: account},
+			})
+		}
+	}
+	for _, account := range accounts {
+		ai, err := client.AccountInfo(account)
+		if err != nil {
+			if err.Error() == "Account not found" {
+				continue
+			}
+			return nil, err
+		}
+		if ai.ConfirmationHeight == 0 {
+			continue
+		}
+		bi, err := client.BlockInfo(ai.ConfirmationHeightFrontier)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &nanows.Confirmation{
+			Account: account,
+			Amount:  bi.Amount,
+			Hash:    ai.ConfirmationHeightFrontier,
+			Block:   bi.Contents,
+		})
+	}
+	return
+}
+
+func newDetector() (d detector, err error) {
+	switch *detect {
+	case "ws":
+		return newWSMux(), nil
+	case "poll":
+		return newPollMux(), nil
+	case "auto":
+	default:
+		return nil, errors.New("unknown detection backend " + *detect)
+	}
+	for _, url := range nodes.wsURLs() {
+		c, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		c.Close()
+		return newWSMux(), nil
+	}
+	log.Print("websocket unavailable, polling for payments")
+	return newPollMux(), nil
+}
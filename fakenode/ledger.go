@@ -0,0 +1,515 @@
+// Package fakenode implements an in-memory Nano node for hermetic testing.
+//
+// The ledger holds state blocks only. Blocks are validated (signature,
+// work, balances, receivables) like a real node would, confirmed after a
+// configurable delay, and published to websocket subscribers. The node
+// speaks enough of the RPC and websocket protocols for the payment server
+// and the gonano wallet to run against it unmodified.
+package fakenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/hectorchu/gonano/rpc"
+	"github.com/hectorchu/gonano/util"
+	"github.com/hectorchu/gonano/wallet/ed25519"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Supply is the amount held by the genesis account.
+var Supply, _ = new(big.Int).SetString("340282366920938463463374607431768211455", 10)
+
+type block struct {
+	rpc.Block
+	hash      rpc.BlockHash
+	subtype   string
+	height    uint64
+	amount    *big.Int
+	confirmed bool
+	received  bool
+	time      time.Time
+}
+
+type account struct {
+	blocks    []*block
+	confirmed uint64
+}
+
+func (a *account) frontier() *block {
+	return a.blocks[len(a.blocks)-1]
+}
+
+// Node is an in-memory ledger.
+type Node struct {
+	// SendThreshold and ReceiveThreshold are the work thresholds for
+	// send/change and receive/open blocks.
+	SendThreshold, ReceiveThreshold uint64
+	// ConfirmDelay is how long a block stays unconfirmed after it is
+	// processed.
+	ConfirmDelay time.Duration
+
+	m        sync.Mutex
+	genesis  ed25519.PrivateKey
+	blocks   map[string]*block
+	accounts map[string]*account
+	cemented uint64
+	subs     map[*wsConn]bool
+}
+
+// New creates a ledger whose genesis account, index 0 of seed, holds the
+// whole supply.
+func New(seed []byte) (n *Node, err error) {
+	key, err := Key(seed, 0)
+	if err != nil {
+		return
+	}
+	n = &Node{
+		SendThreshold:    0xffff000000000000,
+		ReceiveThreshold: 0xfff0000000000000,
+		genesis:          key,
+		blocks:           make(map[string]*block),
+		accounts:         make(map[string]*account),
+		subs:             make(map[*wsConn]bool),
+	}
+	address, _ := Address(key)
+	b := &block{
+		Block: rpc.Block{
+			Type:           "state",
+			Account:        address,
+			Previous:       make(rpc.BlockHash, 32),
+			Representative: address,
+			Balance:        &rpc.RawAmount{Int: *Supply},
+			Link:           make(rpc.BlockHash, 32),
+		},
+		subtype:   "open",
+		height:    1,
+		amount:    new(big.Int).Set(Supply),
+		confirmed: true,
+		received:  true,
+		time:      time.Now(),
+	}
+	if b.hash, err = b.Hash(); err != nil {
+		return
+	}
+	b.LinkAsAccount, _ = util.PubkeyToAddress(b.Link)
+	n.blocks[b.hash.String()] = b
+	n.accounts[address] = &account{blocks: []*block{b}, confirmed: 1}
+	n.cemented = 1
+	return
+}
+
+// Genesis returns the genesis account's private key.
+func (n *Node) Genesis() ed25519.PrivateKey {
+	return n.genesis
+}
+
+// Key derives the private key at index of seed, like a Nano wallet.
+func Key(seed []byte, index uint32) (key ed25519.PrivateKey, err error) {
+	if len(seed) != 32 {
+		return nil, errors.New("seed must be 32 bytes")
+	}
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return
+	}
+	h.Write(seed)
+	binary.Write(h, binary.BigEndian, index)
+	return ed25519.NewKeyFromSeed(h.Sum(nil)), nil
+}
+
+// Address returns the account address of key.
+func Address(key ed25519.PrivateKey) (string, error) {
+	return util.PubkeyToAddress(key[32:])
+}
+
+func (n *Node) workThreshold(subtype string) uint64 {
+	if subtype == "receive" || subtype == "open" {
+		return n.ReceiveThreshold
+	}
+	return n.SendThreshold
+}
+
+func workValue(root, work []byte) uint64 {
+	h, _ := blake2b.New(8, nil)
+	for i := len(work) - 1; i >= 0; i-- {
+		h.Write(work[i : i+1])
+	}
+	h.Write(root)
+	return binary.LittleEndian.Uint64(h.Sum(nil))
+}
+
+// Work generates proof-of-work for root at the given threshold.
+func Work(root []byte, threshold uint64) (work rpc.HexData) {
+	work = make(rpc.HexData, 8)
+	for i := uint64(0); ; i++ {
+		binary.BigEndian.PutUint64(work, i)
+		if workValue(root, work) >= threshold {
+			return
+		}
+	}
+}
+
+func workRoot(b *rpc.Block) (root []byte, err error) {
+	if bytes.Equal(b.Previous, make([]byte, 32)) {
+		return util.AddressToPubkey(b.Account)
+	}
+	return b.Previous, nil
+}
+
+// Process validates and appends a block to the ledger.
+func (n *Node) Process(b *rpc.Block, subtype string) (hash rpc.BlockHash, err error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if b.Type != "state" {
+		return nil, errors.New("Invalid block type")
+	}
+	if b.Balance == nil || len(b.Previous) != 32 || len(b.Link) != 32 {
+		return nil, errors.New("Block is invalid")
+	}
+	if hash, err = b.Hash(); err != nil {
+		return
+	}
+	if _, ok := n.blocks[hash.String()]; ok {
+		return nil, errors.New("Old block")
+	}
+	pubkey, err := util.AddressToPubkey(b.Account)
+	if err != nil {
+		return
+	}
+	if !ed25519.Verify(pubkey, hash, b.Signature) {
+		return nil, errors.New("Bad signature")
+	}
+	nb := &block{Block: *b, hash: hash, amount: new(big.Int), time: time.Now()}
+	nb.Balance = &rpc.RawAmount{Int: *new(big.Int).Set(&b.Balance.Int)}
+	nb.LinkAsAccount, _ = util.PubkeyToAddress(b.Link)
+	balance := new(big.Int)
+	acc := n.accounts[b.Account]
+	if bytes.Equal(b.Previous, make([]byte, 32)) {
+		if acc != nil {
+			return nil, errors.New("Fork")
+		}
+		nb.height = 1
+	} else {
+		prev, ok := n.blocks[b.Previous.String()]
+		if !ok {
+			return nil, errors.New("Gap previous block")
+		}
+		if prev.Account != b.Account {
+			return nil, errors.New("Block is invalid")
+		}
+		if !bytes.Equal(acc.frontier().hash, prev.hash) {
+			return nil, errors.New("Fork")
+		}
+		balance.Set(&prev.Balance.Int)
+		nb.height = prev.height + 1
+	}
+	switch nb.Balance.Cmp(balance) {
+	case -1:
+		nb.subtype = "send"
+		nb.amount.Sub(balance, &nb.Balance.Int)
+	case 1:
+		nb.subtype = "receive"
+		if nb.height == 1 {
+			nb.subtype = "open"
+		}
+		nb.amount.Sub(&nb.Balance.Int, balance)
+		source, ok := n.blocks[b.Link.String()]
+		if !ok {
+			return nil, errors.New("Gap source block")
+		}
+		if source.subtype != "send" || source.LinkAsAccount != b.Account || source.received {
+			return nil, errors.New("Unreceivable")
+		}
+		if source.amount.Cmp(nb.amount) != 0 {
+			return nil, errors.New("Balance mismatch")
+		}
+	default:
+		if !bytes.Equal(b.Link, make([]byte, 32)) || nb.height == 1 {
+			return nil, errors.New("Block is invalid")
+		}
+		nb.subtype = "change"
+	}
+	if subtype != "" && subtype != nb.subtype && !(subtype == "receive" && nb.subtype == "open") {
+		return nil, errors.New("Invalid block balance for given subtype")
+	}
+	root, err := workRoot(b)
+	if err != nil {
+		return
+	}
+	if len(b.Work) != 8 || workValue(root, b.Work) < n.workThreshold(nb.subtype) {
+		return nil, errors.New("Block work is less than threshold")
+	}
+	if nb.subtype == "receive" || nb.subtype == "open" {
+		n.blocks[b.Link.String()].received = true
+	}
+	if acc == nil {
+		acc = new(account)
+		n.accounts[b.Account] = acc
+	}
+	acc.blocks = append(acc.blocks, nb)
+	n.blocks[hash.String()] = nb
+	if n.ConfirmDelay > 0 {
+		time.AfterFunc(n.ConfirmDelay, func() { n.Confirm(hash) })
+	} else {
+		n.confirm(nb)
+	}
+	return
+}
+
+// Confirm cements a block, its predecessors and the sends it receives.
+func (n *Node) Confirm(hash rpc.BlockHash) (err error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	b, ok := n.blocks[hash.String()]
+	if !ok {
+		return errors.New("Block not found")
+	}
+	n.confirm(b)
+	return
+}
+
+func (n *Node) confirm(b *block) {
+	if b.confirmed {
+		return
+	}
+	acc := n.accounts[b.Account]
+	for _, ab := range acc.blocks[acc.confirmed:b.height] {
+		if ab.subtype == "receive" || ab.subtype == "open" {
+			n.confirm(n.blocks[ab.Link.String()])
+		}
+		ab.confirmed = true
+		acc.confirmed = ab.height
+		n.cemented++
+		n.publish(ab)
+	}
+}
+
+func (n *Node) info(b *block) rpc.BlockInfo {
+	contents := b.Block
+	return rpc.BlockInfo{
+		BlockAccount:   b.Account,
+		Amount:         &rpc.RawAmount{Int: *new(big.Int).Set(b.amount)},
+		Balance:        &rpc.RawAmount{Int: *new(big.Int).Set(&b.Balance.Int)},
+		Height:         b.height,
+		LocalTimestamp: uint64(b.time.Unix()),
+		Confirmed:      b.confirmed,
+		Contents:       &contents,
+		Subtype:        b.subtype,
+	}
+}
+
+// BlockInfo returns a block by hash.
+func (n *Node) BlockInfo(hash rpc.BlockHash) (info rpc.BlockInfo, err error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	b, ok := n.blocks[hash.String()]
+	if !ok {
+		return info, errors.New("Block not found")
+	}
+	return n.info(b), nil
+}
+
+func (n *Node) pending(address string, confirmedOnly bool) (pending rpc.HashToPendingMap, total *big.Int) {
+	pending, total = make(rpc.HashToPendingMap), new(big.Int)
+	for _, b := range n.blocks {
+		if b.subtype != "send" || b.LinkAsAccount != address || b.received || confirmedOnly && !b.confirmed {
+			continue
+		}
+		pending[b.hash.String()] = rpc.AccountPending{
+			Amount: &rpc.RawAmount{Int: *new(big.Int).Set(b.amount)},
+			Source: b.Account,
+		}
+		total.Add(total, b.amount)
+	}
+	return
+}
+
+// AccountInfo returns the state of an account.
+func (n *Node) AccountInfo(address string) (info rpc.AccountInfo, err error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	acc, ok := n.accounts[address]
+	if !ok {
+		return info, errors.New("Account not found")
+	}
+	frontier := acc.frontier()
+	_, pending := n.pending(address, false)
+	info = rpc.AccountInfo{
+		Frontier:            frontier.hash,
+		OpenBlock:           acc.blocks[0].hash,
+		RepresentativeBlock: frontier.hash,
+		Balance:             &rpc.RawAmount{Int: *new(big.Int).Set(&frontier.Balance.Int)},
+		ModifiedTimestamp:   uint64(frontier.time.Unix()),
+		BlockCount:          uint64(len(acc.blocks)),
+		ConfirmationHeight:  acc.confirmed,
+		AccountVersion:      2,
+		Representative:      frontier.Representative,
+		Weight:              &rpc.RawAmount{},
+		Pending:             &rpc.RawAmount{Int: *pending},
+	}
+	info.ConfirmationHeightFrontier = make(rpc.BlockHash, 32)
+	if acc.confirmed > 0 {
+		info.ConfirmationHeightFrontier = acc.blocks[acc.confirmed-1].hash
+	}
+	return
+}
+
+// AccountBalance returns the balance and receivable amount of an account.
+func (n *Node) AccountBalance(address string) (balance, pending *rpc.RawAmount, err error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	balance = new(rpc.RawAmount)
+	if acc, ok := n.accounts[address]; ok {
+		balance.Set(&acc.frontier().Balance.Int)
+	}
+	_, total := n.pending(address, false)
+	return balance, &rpc.RawAmount{Int: *total}, nil
+}
+
+// AccountsPending returns the receivable blocks of each account.
+func (n *Node) AccountsPending(accounts []string, count int64) (pending map[string]rpc.HashToPendingMap, err error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	pending = make(map[string]rpc.HashToPendingMap)
+	for _, address := range accounts {
+		p, _ := n.pending(address, true)
+		for hash := range p {
+			if count < 0 || int64(len(p)) <= count {
+				break
+			}
+			delete(p, hash)
+		}
+		if len(p) > 0 {
+			pending[address] = p
+		}
+	}
+	return
+}
+
+// BlockCount returns the number of blocks in the ledger.
+func (n *Node) BlockCount() (cemented, count, unchecked uint64, err error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return n.cemented, uint64(len(n.blocks)), 0, nil
+}
+
+// Successors returns up to count hashes of the account chain starting at hash.
+func (n *Node) Successors(hash rpc.BlockHash, count int64) (blocks []rpc.BlockHash, err error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	b, ok := n.blocks[hash.String()]
+	if !ok {
+		return nil, errors.New("Block not found")
+	}
+	for _, b := range n.accounts[b.Account].blocks[b.height-1:] {
+		if count >= 0 && int64(len(blocks)) >= count {
+			break
+		}
+		blocks = append(blocks, b.hash)
+	}
+	return
+}
+
+// Send publishes a send of amount from key's account to destination.
+func (n *Node) Send(key ed25519.PrivateKey, destination string, amount *big.Int) (hash rpc.BlockHash, err error) {
+	address, err := Address(key)
+	if err != nil {
+		return
+	}
+	link, err := util.AddressToPubkey(destination)
+	if err != nil {
+		return
+	}
+	info, err := n.AccountInfo(address)
+	if err != nil {
+		return
+	}
+	balance := new(big.Int).Sub(&info.Balance.Int, amount)
+	if balance.Sign() < 0 {
+		return nil, errors.New("insufficient funds")
+	}
+	b, err := n.SendBlock(key, info.Frontier, info.Representative, balance, link)
+	if err != nil {
+		return
+	}
+	return n.Process(b, "send")
+}
+
+// SendBlock creates a signed state block with work, without publishing it.
+func (n *Node) SendBlock(
+	key ed25519.PrivateKey, previous rpc.BlockHash, representative string,
+	balance *big.Int, link []byte,
+) (b *rpc.Block, err error) {
+	address, err := Address(key)
+	if err != nil {
+		return
+	}
+	b = &rpc.Block{
+		Type:           "state",
+		Account:        address,
+		Previous:       previous,
+		Representative: representative,
+		Balance:        &rpc.RawAmount{Int: *new(big.Int).Set(balance)},
+		Link:           link,
+	}
+	hash, err := b.Hash()
+	if err != nil {
+		return
+	}
+	b.Signature = ed25519.Sign(key, hash)
+	b.Work = Work(previous, n.SendThreshold)
+	return
+}
+
+// ReceivePendings receives every receivable block of key's account.
+func (n *Node) ReceivePendings(key ed25519.PrivateKey) (err error) {
+	address, err := Address(key)
+	if err != nil {
+		return
+	}
+	pending, err := n.AccountsPending([]string{address}, -1)
+	if err != nil {
+		return
+	}
+	for hash, p := range pending[address] {
+		link, err := hex.DecodeString(hash)
+		if err != nil {
+			return err
+		}
+		info, err := n.AccountInfo(address)
+		previous, representative, balance := info.Frontier, info.Representative, new(big.Int)
+		if err != nil {
+			previous, representative = make(rpc.BlockHash, 32), address
+		} else {
+			balance.Set(&info.Balance.Int)
+		}
+		b := &rpc.Block{
+			Type:           "state",
+			Account:        address,
+			Previous:       previous,
+			Representative: representative,
+			Balance:        &rpc.RawAmount{Int: *balance.Add(balance, &p.Amount.Int)},
+			Link:           link,
+		}
+		hash, err := b.Hash()
+		if err != nil {
+			return err
+		}
+		b.Signature = ed25519.Sign(key, hash)
+		root, err := workRoot(b)
+		if err != nil {
+			return err
+		}
+		b.Work = Work(root, n.ReceiveThreshold)
+		if _, err = n.Process(b, "receive"); err != nil {
+			return err
+		}
+	}
+	return
+}
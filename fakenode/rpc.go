@@ -0,0 +1,188 @@
+package fakenode
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	"github.com/hectorchu/gonano/rpc"
+)
+
+type request struct {
+	Action           string
+	Account          string
+	Accounts         []string
+	Hash             rpc.BlockHash
+	Hashes           []rpc.BlockHash
+	Block            json.RawMessage
+	Subtype          string
+	Count            json.Number
+	Difficulty       rpc.HexData
+	Destination      string
+	Amount           string
+	IncludeConfirmed bool `json:"include_confirmed"`
+}
+
+// ServeHTTP serves node RPC on POST requests and the websocket API on
+// upgrade requests.
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		n.serveWS(w, r)
+		return
+	}
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unable to parse JSON"})
+		return
+	}
+	v, err := n.handle(&req)
+	if err != nil {
+		v = map[string]string{"error": err.Error()}
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+func (n *Node) handle(req *request) (v interface{}, err error) {
+	count := int64(-1)
+	if req.Count != "" {
+		if count, err = req.Count.Int64(); err != nil {
+			return
+		}
+	}
+	switch req.Action {
+	case "account_balance":
+		balance, pending, err := n.AccountBalance(req.Account)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"balance": balance, "pending": pending, "receivable": pending}, nil
+	case "account_info":
+		info, err := n.AccountInfo(req.Account)
+		if err != nil {
+			return nil, err
+		}
+		if !req.IncludeConfirmed {
+			return info, nil
+		}
+		confirmed := rpc.BlockInfo{Balance: &rpc.RawAmount{}}
+		if info.ConfirmationHeight > 0 {
+			if confirmed, err = n.BlockInfo(info.ConfirmationHeightFrontier); err != nil {
+				return nil, err
+			}
+		}
+		return struct {
+			rpc.AccountInfo
+			ConfirmedBalance  *rpc.RawAmount `json:"confirmed_balance"`
+			ConfirmedHeight   uint64         `json:"confirmed_height,string"`
+			ConfirmedFrontier rpc.BlockHash  `json:"confirmed_frontier"`
+		}{info, confirmed.Balance, info.ConfirmationHeight, info.ConfirmationHeightFrontier}, nil
+	case "accounts_frontiers":
+		frontiers := make(map[string]rpc.BlockHash)
+		for _, account := range req.Accounts {
+			if info, err := n.AccountInfo(account); err == nil {
+				frontiers[account] = info.Frontier
+			}
+		}
+		return map[string]interface{}{"frontiers": frontiers}, nil
+	case "accounts_balances":
+		balances := make(map[string]*rpc.AccountBalance)
+		for _, account := range req.Accounts {
+			balance, pending, _ := n.AccountBalance(account)
+			balances[account] = &rpc.AccountBalance{Balance: balance, Pending: pending}
+		}
+		return map[string]interface{}{"balances": balances}, nil
+	case "accounts_pending", "accounts_receivable":
+		pending, err := n.AccountsPending(req.Accounts, count)
+		if err != nil {
+			return nil, err
+		}
+		blocks := make(map[string]interface{})
+		for account, p := range pending {
+			blocks[account] = p
+		}
+		if len(blocks) == 0 {
+			return map[string]string{"blocks": ""}, nil
+		}
+		return map[string]interface{}{"blocks": blocks}, nil
+	case "active_difficulty":
+		return map[string]string{
+			"network_minimum":         strconv.FormatUint(n.SendThreshold, 16),
+			"network_receive_minimum": strconv.FormatUint(n.ReceiveThreshold, 16),
+			"network_current":         strconv.FormatUint(n.SendThreshold, 16),
+			"multiplier":              "1",
+		}, nil
+	case "block_count":
+		cemented, count, unchecked, _ := n.BlockCount()
+		return map[string]string{
+			"count":     strconv.FormatUint(count, 10),
+			"unchecked": strconv.FormatUint(unchecked, 10),
+			"cemented":  strconv.FormatUint(cemented, 10),
+		}, nil
+	case "block_info":
+		return n.BlockInfo(req.Hash)
+	case "blocks_info":
+		blocks := make(map[string]rpc.BlockInfo)
+		for _, hash := range req.Hashes {
+			info, err := n.BlockInfo(hash)
+			if err != nil {
+				return nil, err
+			}
+			blocks[hash.String()] = info
+		}
+		return map[string]interface{}{"blocks": blocks}, nil
+	case "process":
+		var b rpc.Block
+		if err = json.Unmarshal(req.Block, &b); err != nil {
+			return
+		}
+		hash, err := n.Process(&b, req.Subtype)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]rpc.BlockHash{"hash": hash}, nil
+	case "successors":
+		var hash rpc.BlockHash
+		if err = json.Unmarshal(req.Block, &hash); err != nil {
+			return
+		}
+		blocks, err := n.Successors(hash, count)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]rpc.BlockHash{"blocks": blocks}, nil
+	case "version":
+		return map[string]string{
+			"rpc_version":      "1",
+			"protocol_version": "18",
+			"node_vendor":      "fakenode",
+			"network":          "test",
+		}, nil
+	case "work_generate":
+		threshold := n.SendThreshold
+		if len(req.Difficulty) == 8 {
+			threshold = new(big.Int).SetBytes(req.Difficulty).Uint64()
+		}
+		return map[string]string{
+			"work":       hex.EncodeToString(Work(req.Hash, threshold)),
+			"difficulty": hex.EncodeToString(req.Difficulty),
+			"multiplier": "1",
+		}, nil
+	case "work_cancel":
+		return map[string]string{}, nil
+	case "faucet":
+		amount, ok := new(big.Int).SetString(req.Amount, 10)
+		if !ok {
+			return nil, errors.New("Bad amount number")
+		}
+		hash, err := n.Send(n.genesis, req.Destination, amount)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]rpc.BlockHash{"hash": hash}, nil
+	}
+	return nil, errors.New("Unknown command")
+}
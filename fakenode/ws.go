@@ -0,0 +1,136 @@
+package fakenode
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hectorchu/gonano/rpc"
+)
+
+type wsConn struct {
+	m          sync.Mutex
+	subscribed bool
+	accounts   map[string]bool
+	ch         chan interface{}
+}
+
+func (c *wsConn) wants(account, link string) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.subscribed && (c.accounts == nil || c.accounts[account] || c.accounts[link])
+}
+
+var upgrader = websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+
+func (n *Node) serveWS(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &wsConn{ch: make(chan interface{}, 256)}
+	n.m.Lock()
+	n.subs[c] = true
+	n.m.Unlock()
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case m := <-c.ch:
+				if ws.WriteJSON(m) != nil {
+					ws.Close()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer func() {
+		n.m.Lock()
+		delete(n.subs, c)
+		n.m.Unlock()
+		close(done)
+		ws.Close()
+	}()
+	for {
+		var v struct {
+			Action  string
+			Topic   string
+			Ack     bool
+			Options struct {
+				Accounts    []string
+				AccountsAdd []string `json:"accounts_add"`
+				AccountsDel []string `json:"accounts_del"`
+			}
+		}
+		if err := ws.ReadJSON(&v); err != nil {
+			return
+		}
+		if v.Topic != "confirmation" {
+			c.ch <- map[string]string{"error": "Invalid topic"}
+			continue
+		}
+		c.m.Lock()
+		switch v.Action {
+		case "subscribe":
+			c.subscribed, c.accounts = true, nil
+			if v.Options.Accounts != nil {
+				c.accounts = make(map[string]bool)
+				for _, account := range v.Options.Accounts {
+					c.accounts[account] = true
+				}
+			}
+		case "update":
+			if c.accounts != nil {
+				for _, account := range v.Options.AccountsAdd {
+					c.accounts[account] = true
+				}
+				for _, account := range v.Options.AccountsDel {
+					delete(c.accounts, account)
+				}
+			}
+		case "unsubscribe":
+			c.subscribed = false
+		}
+		c.m.Unlock()
+		if v.Ack {
+			c.ch <- map[string]string{"ack": v.Action, "time": timestamp(time.Now())}
+		}
+	}
+}
+
+func timestamp(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/1e6, 10)
+}
+
+// publish sends a confirmation to interested websocket subscribers.
+// Subscribers which fall behind miss messages, as with a real node.
+func (n *Node) publish(b *block) {
+	block := b.Block
+	m, _ := json.Marshal(map[string]interface{}{
+		"account":           b.Account,
+		"amount":            b.amount.String(),
+		"hash":              b.hash,
+		"confirmation_type": "active_quorum",
+		"block": struct {
+			*rpc.Block
+			Subtype string `json:"subtype"`
+		}{&block, b.subtype},
+	})
+	v := map[string]interface{}{
+		"topic":   "confirmation",
+		"time":    timestamp(time.Now()),
+		"message": json.RawMessage(m),
+	}
+	for c := range n.subs {
+		if c.wants(b.Account, b.LinkAsAccount) {
+			select {
+			case c.ch <- v:
+			default:
+			}
+		}
+	}
+}
@@ -7,9 +7,10 @@ require (
 	github.com/hectorchu/gonano v0.1.17
 	github.com/hexops/vecty v0.6.0
 	github.com/kevinpollet/nego v0.0.0-20201213172553-d6ce2e30cfd6 // indirect
+	github.com/lib/pq v1.10.9
 	github.com/lpar/gzipped/v2 v2.0.2
 	github.com/mattn/go-sqlite3 v1.14.11
-	golang.org/x/crypto v0.0.0-20220210151621-f4118a5b28e2 // indirect
+	golang.org/x/crypto v0.0.0-20220210151621-f4118a5b28e2
 	golang.org/x/sys v0.0.0-20220209214540-3681064d5158 // indirect
 	nhooyr.io/websocket v1.8.6
 )
@@ -2,12 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/hectorchu/gonano/rpc"
@@ -26,7 +28,7 @@ func serverError(w http.ResponseWriter, err error) {
 	fmt.Fprintln(w, err)
 }
 
-func newPaymentHandler(wallet *Wallet) http.HandlerFunc {
+func newPaymentHandler(wallet *Wallet, det detector) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var v struct{ Account, Amount string }
 		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
@@ -54,22 +56,22 @@ func newPaymentHandler(wallet *Wallet) http.HandlerFunc {
 			badRequest(w, errors.New("amount must be positive"))
 			return
 		}
-		payment, err := newPaymentRequest(v.Account, amount.Raw)
+		payment, err := store.newPaymentRequest(v.Account, amount.Raw)
 		if err != nil {
 			serverError(w, err)
 			return
 		}
 		for index := uint32(0); ; {
-			if index, err = getFreeWalletIndex(payment.id, index); err != nil {
+			if index, err = store.getFreeWalletIndex(payment.id, index); err != nil {
 				serverError(w, err)
 				return
 			}
-			a, err := wallet.getAccount(index)
+			a, err := wallet.getAccount(r.Context(), index, priorityForward)
 			if err != nil {
 				serverError(w, err)
 				return
 			}
-			client := rpc.Client{URL: *rpcURL}
+			client := stickyClient(r.Context(), a.Address())
 			ai, err := client.AccountInfo(a.Address())
 			if err != nil && err.Error() != "Account not found" {
 				serverError(w, err)
@@ -83,14 +85,16 @@ func newPaymentHandler(wallet *Wallet) http.HandlerFunc {
 				}
 				if balance.Sign() == 0 && pending.Sign() == 0 {
 					v.Account = a.Address()
+					precomputeWork(a.Address(), ai.Frontier, balance)
 					break
 				}
 			}
-			if err = freeWalletIndex(payment.id); err != nil {
+			if err = store.freeWalletIndex(payment.id); err != nil {
 				serverError(w, err)
 				return
 			}
 		}
+		watchers.start(wallet, det, payment.id)
 		if err = json.NewEncoder(w).Encode(map[string]string{
 			"id":      payment.id,
 			"account": v.Account,
@@ -101,7 +105,7 @@ func newPaymentHandler(wallet *Wallet) http.HandlerFunc {
 	}
 }
 
-func waitPaymentHandler(wallet *Wallet, ws *wsMux) http.HandlerFunc {
+func waitPaymentHandler(wallet *Wallet, det detector) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var v struct {
 			ID      string
@@ -115,12 +119,74 @@ func waitPaymentHandler(wallet *Wallet, ws *wsMux) http.HandlerFunc {
 			badRequest(w, errors.New("missing payment id"))
 			return
 		}
+		if v.Timeout == 0 {
+			v.Timeout = 1800
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), v.Timeout*time.Second)
+		defer cancel()
+		for {
+			payment, err := store.getPaymentRequest(v.ID)
+			if err == sql.ErrNoRows {
+				badRequest(w, errors.New("invalid payment id"))
+				return
+			} else if err != nil {
+				serverError(w, err)
+				return
+			}
+			if payment.handoff == "failed" {
+				badRequest(w, errors.New("payment failed: "+payment.reason))
+				return
+			}
+			if payment.state != "" {
+				badRequest(w, errors.New("payment "+payment.state+": "+payment.reason))
+				return
+			}
+			if payment.hash != nil && payment.handoff != "pending" {
+				if err = json.NewEncoder(w).Encode(map[string]string{
+					"id":         payment.id,
+					"block_hash": payment.hash.String(),
+				}); err != nil {
+					serverError(w, err)
+				}
+				return
+			}
+			// A handed-off block is waited on until it is confirmed or
+			// fails, rather than reported as soon as it is published.
+			if payment.hash == nil {
+				select {
+				case <-watchers.start(wallet, det, payment.id):
+				case <-ctx.Done():
+					serverError(w, ctx.Err())
+					return
+				}
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				serverError(w, ctx.Err())
+				return
+			}
+		}
+	}
+}
+
+func cancelPaymentHandler(wallet *Wallet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var v struct{ ID, Reason string }
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			badRequest(w, err)
+			return
+		}
+		if v.ID == "" {
+			badRequest(w, errors.New("missing payment id"))
+			return
+		}
 		paymentMutex.lock(v.ID)
 		defer paymentMutex.unlock(v.ID)
 		if r.Context().Err() != nil {
 			return
 		}
-		payment, err := getPaymentRequest(v.ID)
+		payment, err := store.getPaymentRequest(v.ID)
 		if err == sql.ErrNoRows {
 			badRequest(w, errors.New("invalid payment id"))
 			return
@@ -129,67 +195,44 @@ func waitPaymentHandler(wallet *Wallet, ws *wsMux) http.HandlerFunc {
 			return
 		}
 		if payment.hash != nil {
-			if err = json.NewEncoder(w).Encode(map[string]string{
-				"id":         payment.id,
-				"block_hash": payment.hash.String(),
-			}); err != nil {
-				serverError(w, err)
-			}
-			return
-		}
-		index, err := getWalletIndex(payment.id)
-		if err != nil {
-			serverError(w, err)
-			return
-		}
-		a, err := wallet.getAccount(index)
-		if err != nil {
-			serverError(w, err)
+			badRequest(w, errors.New("payment already fulfilled"))
 			return
 		}
-		if v.Timeout == 0 {
-			v.Timeout = 1800
-		}
-		hash, err := waitReceive(r.Context(), ws, a, payment.account, payment.amount.Raw, v.Timeout*time.Second)
-		if err != nil {
-			serverError(w, err)
+		if payment.state != "" {
+			badRequest(w, errors.New("payment already "+payment.state))
 			return
 		}
-		if err = updatePaymentRequest(payment.id, hash); err != nil {
-			serverError(w, err)
-			return
+		if v.Reason == "" {
+			v.Reason = "cancelled by request"
 		}
-		if err = freeWalletIndex(payment.id); err != nil {
-			serverError(w, err)
+		if err = cancel(r.Context(), wallet, payment.id, "cancelled", v.Reason, "api"); err != nil {
+			if err.Error() == "payment already fulfilled" {
+				badRequest(w, err)
+			} else {
+				serverError(w, err)
+			}
 			return
 		}
-		if err = json.NewEncoder(w).Encode(map[string]string{
-			"id":         payment.id,
-			"block_hash": hash.String(),
-		}); err != nil {
+		if err = json.NewEncoder(w).Encode(map[string]string{}); err != nil {
 			serverError(w, err)
 			return
 		}
 	}
 }
 
-func cancelPaymentHandler(wallet *Wallet) http.HandlerFunc {
+func handoffPaymentHandler(wallet *Wallet, det detector) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var v struct{ ID string }
-		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
-			badRequest(w, err)
-			return
-		}
-		if v.ID == "" {
+		id, ok := r.URL.Query()["id"]
+		if !ok {
 			badRequest(w, errors.New("missing payment id"))
 			return
 		}
-		paymentMutex.lock(v.ID)
-		defer paymentMutex.unlock(v.ID)
+		paymentMutex.lock(id[0])
+		defer paymentMutex.unlock(id[0])
 		if r.Context().Err() != nil {
 			return
 		}
-		payment, err := getPaymentRequest(v.ID)
+		payment, err := store.getPaymentRequest(id[0])
 		if err == sql.ErrNoRows {
 			badRequest(w, errors.New("invalid payment id"))
 			return
@@ -197,33 +240,86 @@ func cancelPaymentHandler(wallet *Wallet) http.HandlerFunc {
 			serverError(w, err)
 			return
 		}
-		if payment.hash != nil {
-			badRequest(w, errors.New("payment already fulfilled"))
+		if payment.handoff == "failed" {
+			badRequest(w, errors.New("payment failed: "+payment.reason))
+			return
+		}
+		if payment.state != "" {
+			badRequest(w, errors.New("payment "+payment.state+": "+payment.reason))
+			return
+		}
+		var block rpc.Block
+		if err = json.NewDecoder(r.Body).Decode(&block); err != nil {
+			if err == io.EOF {
+				err = errors.New("please paste this URL into a wallet which supports payment URLs")
+			}
+			badRequest(w, err)
+			return
+		}
+		hash, err := validateBlock(r.Context(), &block, payment.account, payment.amount.Raw)
+		if err != nil {
+			badRequest(w, err)
 			return
 		}
-		if err = cancel(wallet, payment.id); err != nil {
+		watchers.hold(payment.id)
+		defer watchers.release(payment.id)
+		if payment, err = store.getPaymentRequest(payment.id); err != nil {
 			serverError(w, err)
 			return
 		}
-		if err = json.NewEncoder(w).Encode(map[string]string{}); err != nil {
+		if payment.hash != nil && !bytes.Equal(hash, payment.hash) {
+			badRequest(w, errors.New("block for this payment id has already been submitted"))
+			return
+		}
+		if payment.hash == nil {
+			if err = store.updatePaymentHandoff(payment.id, hash, &block); err != nil {
+				serverError(w, err)
+				return
+			}
+			if err = publishHandoff(payment.id, &block, hash); err != nil {
+				if err.Error() == "Fork" {
+					reason := "fork: a competing block was published for the same previous block"
+					if err = failHandoff(payment.id, hash, reason); err != nil {
+						serverError(w, err)
+						return
+					}
+					badRequest(w, errors.New(reason))
+				} else if err2 := store.revertPaymentHandoff(payment.id); err2 != nil {
+					serverError(w, err2)
+				} else {
+					watchers.release(payment.id)
+					watchers.start(wallet, det, payment.id)
+					serverError(w, err)
+				}
+				return
+			}
+			if err = store.freeWalletIndex(payment.id); err != nil {
+				serverError(w, err)
+				return
+			}
+			go monitorHandoff(payment.id, &block, hash)
+		}
+		if err = json.NewEncoder(w).Encode(map[string]string{
+			"id":         payment.id,
+			"block_hash": hash.String(),
+		}); err != nil {
 			serverError(w, err)
 			return
 		}
 	}
 }
 
-func handoffPaymentHandler(w http.ResponseWriter, r *http.Request) {
-	id, ok := r.URL.Query()["id"]
-	if !ok {
-		badRequest(w, errors.New("missing payment id"))
+func statusPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	var v struct{ ID string }
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		badRequest(w, err)
 		return
 	}
-	paymentMutex.lock(id[0])
-	defer paymentMutex.unlock(id[0])
-	if r.Context().Err() != nil {
+	if v.ID == "" {
+		badRequest(w, errors.New("missing payment id"))
 		return
 	}
-	payment, err := getPaymentRequest(id[0])
+	payment, err := store.getPaymentRequest(v.ID)
 	if err == sql.ErrNoRows {
 		badRequest(w, errors.New("invalid payment id"))
 		return
@@ -231,78 +327,120 @@ func handoffPaymentHandler(w http.ResponseWriter, r *http.Request) {
 		serverError(w, err)
 		return
 	}
-	var block rpc.Block
-	if err = json.NewDecoder(r.Body).Decode(&block); err != nil {
-		if err == io.EOF {
-			err = errors.New("please paste this URL into a wallet which supports payment URLs")
+	status := map[string]interface{}{
+		"id":         payment.id,
+		"block_hash": payment.hash.String(),
+		"status":     payment.status(),
+	}
+	if payment.reason != "" {
+		status["reason"] = payment.reason
+	}
+	if payment.state != "" {
+		refunds := make([]string, len(payment.refunds))
+		for i, hash := range payment.refunds {
+			refunds[i] = hash.String()
 		}
-		badRequest(w, err)
+		status["refunds"] = refunds
+		status["closed_by"] = payment.closedBy
+		status["closed_at"] = payment.closedAt.UTC().Format(time.RFC3339)
+	}
+	if err = json.NewEncoder(w).Encode(status); err != nil {
+		serverError(w, err)
 		return
 	}
-	hash, err := validateBlock(&block, payment.account, payment.amount.Raw)
-	if err != nil {
+}
+
+func journalPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	var v struct{ ID string }
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
 		badRequest(w, err)
 		return
 	}
-	if payment.hash != nil && !bytes.Equal(hash, payment.hash) {
-		badRequest(w, errors.New("block for this payment id has already been submitted"))
+	if v.ID == "" {
+		badRequest(w, errors.New("missing payment id"))
 		return
 	}
-	if err = updatePaymentRequest(payment.id, hash); err != nil {
-		serverError(w, err)
+	if _, err := store.getPaymentRequest(v.ID); err == sql.ErrNoRows {
+		badRequest(w, errors.New("invalid payment id"))
 		return
-	}
-	if err = freeWalletIndex(payment.id); err != nil {
+	} else if err != nil {
 		serverError(w, err)
 		return
 	}
-	if err = sendBlock(&block); err != nil {
+	journal, err := store.getJournal(v.ID)
+	if err != nil {
 		serverError(w, err)
 		return
 	}
-	var buf bytes.Buffer
-	if err = json.NewEncoder(&buf).Encode(map[string]string{
-		"id":         payment.id,
-		"block_hash": hash.String(),
-	}); err != nil {
-		serverError(w, err)
-		return
+	entries := make([]map[string]string, 0, len(journal))
+	for _, j := range journal {
+		entries = append(entries, map[string]string{
+			"kind":       j.kind,
+			"block_hash": j.hash.String(),
+			"debit":      j.debit,
+			"credit":     j.credit,
+			"amount":     j.amount.String(),
+			"time":       j.time.UTC().Format(time.RFC3339),
+		})
 	}
-	if _, err = io.Copy(w, &buf); err != nil {
+	if err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":      v.ID,
+		"entries": entries,
+	}); err != nil {
 		serverError(w, err)
 		return
 	}
-	if *callbackURL != "" {
-		resp, err := http.Post(*callbackURL, "application/json", &buf)
-		if err != nil {
-			serverError(w, err)
-			return
-		}
-		resp.Body.Close()
-	}
 }
 
-func statusPaymentHandler(w http.ResponseWriter, r *http.Request) {
-	var v struct{ ID string }
-	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
-		badRequest(w, err)
-		return
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		after int64
+		limit = 100
+		err   error
+	)
+	if v := r.URL.Query().Get("after"); v != "" {
+		if after, err = strconv.ParseInt(v, 10, 64); err != nil {
+			badRequest(w, errors.New("invalid cursor"))
+			return
+		}
 	}
-	if v.ID == "" {
-		badRequest(w, errors.New("missing payment id"))
-		return
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > 1000 {
+			badRequest(w, errors.New("limit must be between 1 and 1000"))
+			return
+		}
 	}
-	payment, err := getPaymentRequest(v.ID)
-	if err == sql.ErrNoRows {
-		badRequest(w, errors.New("invalid payment id"))
-		return
-	} else if err != nil {
+	events, err := store.getEvents(after, limit)
+	if err != nil {
 		serverError(w, err)
 		return
 	}
-	if err = json.NewEncoder(w).Encode(map[string]string{
-		"id":         payment.id,
-		"block_hash": payment.hash.String(),
+	list := make([]map[string]string, 0, len(events))
+	for _, e := range events {
+		event := map[string]string{
+			"cursor": strconv.FormatInt(e.seq, 10),
+			"id":     e.id,
+			"type":   e.typ,
+			"time":   e.time.UTC().Format(time.RFC3339),
+		}
+		if e.hash != nil {
+			event["block_hash"] = e.hash.String()
+		}
+		if e.account != "" {
+			event["account"] = e.account
+		}
+		if e.amount != nil {
+			event["amount"] = e.amount.String()
+		}
+		if e.reason != "" {
+			event["reason"] = e.reason
+		}
+		list = append(list, event)
+		after = e.seq
+	}
+	if err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"events": list,
+		"cursor": strconv.FormatInt(after, 10),
 	}); err != nil {
 		serverError(w, err)
 		return
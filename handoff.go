@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/hectorchu/gonano/rpc"
+)
+
+var handoffMonitors = newMutexMap()
+
+// monitorHandoff waits until the handed-off block is confirmed or forked,
+// retrying with backoff for as long as it takes. At most one monitor runs
+// per payment.
+func monitorHandoff(id string, block *rpc.Block, hash rpc.BlockHash) {
+	if !handoffMonitors.tryLock(id) {
+		return
+	}
+	defer handoffMonitors.unlock(id)
+	var err error
+	for backoff := 5 * time.Second; ; {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		if err = waitConfirmation(ctx, block, hash, "send"); err == nil {
+			err = waitQuorum(ctx, hash)
+		}
+		cancel()
+		if _, ok := err.(*forkError); err == nil || ok {
+			break
+		}
+		log.Printf("payment %s: handoff block %s: %v, retrying in %v", id, hash, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 10*time.Minute {
+			backoff = 10 * time.Minute
+		}
+	}
+	paymentMutex.lock(id)
+	fe, forked := err.(*forkError)
+	if forked {
+		err = store.failPaymentHandoff(id, fe.Error())
+	} else {
+		err = store.confirmPaymentHandoff(id)
+	}
+	paymentMutex.unlock(id)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if forked {
+		err = postHandoffFailed(id, hash, fe.Error())
+	} else {
+		err = postCallback(map[string]string{
+			"id":         id,
+			"block_hash": hash.String(),
+			"status":     "completed",
+		})
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// publishHandoff publishes a handed-off block with a context of its own, so
+// that a payer who goes away cannot abandon it halfway. It fails only when
+// the node rejected the block and does not have it; when the outcome is
+// unknown, such as after a timeout or a lost response, the handoff stays
+// pending for monitorHandoff, which republishes the block if it stalls.
+func publishHandoff(id string, block *rpc.Block, hash rpc.BlockHash) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err = sendBlock(ctx, block); err == nil || err.Error() == "Fork" {
+		return
+	}
+	_, unknown := err.(*url.Error)
+	if _, err2 := stickyClient(ctx, block.Account).BlockInfo(hash); err2 == nil {
+		log.Printf("payment %s: handoff block %s published despite %v", id, hash, err)
+	} else if unknown || err2.Error() != "Block not found" {
+		log.Printf("payment %s: handoff block %s: %v, monitoring it", id, hash, err)
+	} else {
+		return
+	}
+	return nil
+}
+
+// resumeHandoffs monitors pending handoffs again whose monitor is not
+// running, such as one which could not record the confirmation.
+func resumeHandoffs() {
+	handoffs, err := store.getPendingHandoffs()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for id, data := range handoffs {
+		if err = resumeHandoff(id, data); err != nil {
+			log.Printf("payment %s: %v", id, err)
+		}
+	}
+}
+
+func resumeHandoff(id, data string) (err error) {
+	if !paymentMutex.tryLock(id) {
+		return
+	}
+	defer paymentMutex.unlock(id)
+	payment, err := store.getPaymentRequest(id)
+	if err != nil || payment.handoff != "pending" {
+		return
+	}
+	var block rpc.Block
+	if err = json.Unmarshal([]byte(data), &block); err != nil {
+		return
+	}
+	hash, err := block.Hash()
+	if err != nil {
+		return
+	}
+	go monitorHandoff(id, &block, hash)
+	return
+}
+
+func failHandoff(id string, hash rpc.BlockHash, reason string) (err error) {
+	if err = store.failPaymentHandoff(id, reason); err != nil {
+		return
+	}
+	return postHandoffFailed(id, hash, reason)
+}
+
+func postHandoffFailed(id string, hash rpc.BlockHash, reason string) error {
+	return postCallback(map[string]string{
+		"id":         id,
+		"block_hash": hash.String(),
+		"status":     "failed",
+		"reason":     reason,
+	})
+}
@@ -5,32 +5,78 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
+
+	"github.com/hectorchu/nano-payment-server/recording"
 )
 
 var (
-	port        = flag.Int("p", 7080, "Listen port")
-	dbPath      = flag.String("db", "./data.db", "Path to DB")
-	rpcURL      = flag.String("rpc", "http://[::1]:7076", "RPC URL")
-	powURL      = flag.String("pow", "", "RPC Proof-of-Work URL")
-	wsURL       = flag.String("ws", "ws://[::1]:7078", "WebSocket URL")
-	callbackURL = flag.String("cb", "", "Callback URL when payment is fulfilled")
+	port             = flag.Int("p", 7080, "Listen port")
+	metricsAddr      = flag.String("metrics", "127.0.0.1:7081", "Listen address for metrics at /debug/vars (empty to disable)")
+	dbPath           = flag.String("db", "./data.db", "Path to SQLite DB, or PostgreSQL URL (postgres://...)")
+	rpcURL           = flag.String("rpc", "http://[::1]:7076", "Comma-separated RPC URLs, in order of preference")
+	rpcMaxLag        = flag.Uint64("rpc-max-lag", 1000, "Blocks a node may lag behind the others before it is considered unhealthy")
+	powURL           = flag.String("pow", "", "Comma-separated RPC Proof-of-Work URLs (\"node\" for the RPC URL)")
+	powCPU           = flag.Bool("pow-cpu", true, "Generate Proof-of-Work on the CPU when no work peer succeeds")
+	powTimeout       = flag.Duration("pow-timeout", 30*time.Second, "Timeout for work peer requests")
+	powMaxMultiplier = flag.Float64("pow-max-multiplier", 8, "Maximum multiplier applied to the base difficulty under congestion")
+	powStall         = flag.Duration("pow-stall", time.Minute, "Republish an unconfirmed block with higher work after this long")
+	wsURL            = flag.String("ws", "ws://[::1]:7078", "Comma-separated WebSocket URLs, paired with the RPC URLs")
+	detect           = flag.String("detect", "auto", "Payment detection backend (auto, ws or poll)")
+	callbackURL      = flag.String("cb", "", "Callback URL when payment is fulfilled")
+	quorumURL        = flag.String("quorum-rpc", "", "Comma-separated RPC URLs of independent nodes verifying confirmations")
+	quorum           = flag.Int("quorum", 0, "Number of quorum nodes which must report a block confirmed before settling")
+	strict           = flag.Bool("strict", false, "Validate handoff blocks against the confirmed frontier")
+	recordPath       = flag.String("record", "", "Record node RPC and WebSocket traffic to this file")
+	retention        = flag.Int("retention", 0, "Days to keep cancelled and expired payments before archiving them (0 keeps them)")
+	retentionPurge   = flag.Bool("retention-purge", false, "Purge cancelled and expired payments past -retention instead of archiving them")
 )
 
+var traffic *recording.Writer
+
 func main() {
 	flag.Parse()
 	if err := initDB(); err != nil {
 		log.Fatal(err)
 	}
+	if flag.Arg(0) == "migrate" {
+		if err := migrateCommand(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := applyMigrations(); err != nil {
+		log.Fatal(err)
+	}
+	if *recordPath != "" {
+		var err error
+		if traffic, err = recording.Create(*recordPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	initNodes()
+	initQuorum()
+	initWorkPeers()
 	w, err := loadWallet()
 	if err != nil {
 		log.Fatal(err)
 	}
+	det, err := newDetector()
+	if err != nil {
+		log.Fatal(err)
+	}
+	recoverPayments(w, det)
 	go scavenger(w)
-	ws := newWSMux(*wsURL)
-	http.HandleFunc("/payment/new", newPaymentHandler(w))
-	http.HandleFunc("/payment/wait", waitPaymentHandler(w, ws))
-	http.HandleFunc("/payment/cancel", cancelPaymentHandler(w))
-	http.HandleFunc("/payment/pay", handoffPaymentHandler)
-	http.HandleFunc("/payment/status", statusPaymentHandler)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/payment/new", newPaymentHandler(w, det))
+	mux.HandleFunc("/payment/wait", waitPaymentHandler(w, det))
+	mux.HandleFunc("/payment/cancel", cancelPaymentHandler(w))
+	mux.HandleFunc("/payment/pay", handoffPaymentHandler(w, det))
+	mux.HandleFunc("/payment/status", statusPaymentHandler)
+	mux.HandleFunc("/payment/journal", journalPaymentHandler)
+	mux.HandleFunc("/events", eventsHandler)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), mux))
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+)
+
+// serveMetrics serves the published variables, except the command line
+// which may carry credentials, on their own listener so that they are not
+// exposed with the API.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		vars := make(map[string]json.RawMessage)
+		expvar.Do(func(kv expvar.KeyValue) {
+			if kv.Key != "cmdline" {
+				vars[kv.Key] = json.RawMessage(kv.Value.String())
+			}
+		})
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(vars)
+	})
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is a numbered schema change, with statements for each backend.
+// Migrations are applied in order and never edited once released.
+type migration struct {
+	version     int
+	description string
+	sqlite      []string
+	postgres    []string
+}
+
+var migrations = []migration{{
+	version:     1,
+	description: "initial schema",
+	sqlite: []string{
+		"CREATE TABLE IF NOT EXISTS config(key TEXT PRIMARY KEY, value TEXT)",
+		"CREATE TABLE IF NOT EXISTS payments(id TEXT PRIMARY KEY, account TEXT, amount TEXT, block_hash TEXT)",
+		"CREATE TABLE IF NOT EXISTS handoffs(id TEXT PRIMARY KEY, block TEXT, status TEXT, reason TEXT)",
+		"CREATE TABLE IF NOT EXISTS wallet(id TEXT, time INTEGER)",
+		"CREATE TABLE IF NOT EXISTS work_cache(root TEXT PRIMARY KEY, work TEXT, time INTEGER)",
+	},
+	postgres: []string{
+		"CREATE TABLE IF NOT EXISTS config(key TEXT PRIMARY KEY, value TEXT)",
+		"CREATE TABLE IF NOT EXISTS payments(id TEXT PRIMARY KEY, account TEXT, amount TEXT, block_hash TEXT)",
+		"CREATE TABLE IF NOT EXISTS handoffs(id TEXT PRIMARY KEY, block TEXT, status TEXT, reason TEXT)",
+		"CREATE TABLE IF NOT EXISTS wallet(idx BIGSERIAL PRIMARY KEY, id TEXT NOT NULL DEFAULT '', time BIGINT)",
+		"CREATE TABLE IF NOT EXISTS work_cache(root TEXT PRIMARY KEY, work TEXT, time BIGINT)",
+	},
+}, {
+	version:     2,
+	description: "NOT NULL constraints and indexes",
+	// SQLite cannot add constraints to existing columns, so its tables are
+	// rebuilt. The wallet rowid becomes an explicit idx column, keeping the
+	// indexes from which intermediate accounts are derived.
+	sqlite: []string{
+		"CREATE TABLE config_new(key TEXT PRIMARY KEY, value TEXT NOT NULL)",
+		"INSERT INTO config_new SELECT key, value FROM config WHERE value IS NOT NULL",
+		"DROP TABLE config",
+		"ALTER TABLE config_new RENAME TO config",
+
+		"CREATE TABLE payments_new(id TEXT PRIMARY KEY, account TEXT NOT NULL, amount TEXT NOT NULL, block_hash TEXT NOT NULL DEFAULT '')",
+		"INSERT INTO payments_new SELECT id, account, amount, COALESCE(block_hash, '') FROM payments",
+		"DROP TABLE payments",
+		"ALTER TABLE payments_new RENAME TO payments",
+
+		"CREATE TABLE handoffs_new(id TEXT PRIMARY KEY, block TEXT NOT NULL, status TEXT NOT NULL, reason TEXT NOT NULL DEFAULT '')",
+		"INSERT INTO handoffs_new SELECT id, block, status, COALESCE(reason, '') FROM handoffs",
+		"DROP TABLE handoffs",
+		"ALTER TABLE handoffs_new RENAME TO handoffs",
+
+		"CREATE TABLE wallet_new(idx INTEGER PRIMARY KEY, id TEXT NOT NULL DEFAULT '', time INTEGER)",
+		"INSERT INTO wallet_new SELECT rowid, COALESCE(id, ''), time FROM wallet",
+		"DROP TABLE wallet",
+		"ALTER TABLE wallet_new RENAME TO wallet",
+
+		"CREATE TABLE work_cache_new(root TEXT PRIMARY KEY, work TEXT NOT NULL, time INTEGER NOT NULL)",
+		"INSERT INTO work_cache_new SELECT root, work, time FROM work_cache WHERE work IS NOT NULL AND time IS NOT NULL",
+		"DROP TABLE work_cache",
+		"ALTER TABLE work_cache_new RENAME TO work_cache",
+
+		"CREATE INDEX handoffs_status ON handoffs(status)",
+		"CREATE INDEX wallet_id ON wallet(id)",
+		"CREATE INDEX wallet_time ON wallet(time)",
+		"CREATE INDEX work_cache_time ON work_cache(time)",
+	},
+	postgres: []string{
+		"DELETE FROM config WHERE value IS NULL",
+		"ALTER TABLE config ALTER COLUMN value SET NOT NULL",
+		"UPDATE payments SET block_hash = '' WHERE block_hash IS NULL",
+		`ALTER TABLE payments ALTER COLUMN account SET NOT NULL, ALTER COLUMN amount SET NOT NULL,
+			ALTER COLUMN block_hash SET DEFAULT '', ALTER COLUMN block_hash SET NOT NULL`,
+		"UPDATE handoffs SET reason = '' WHERE reason IS NULL",
+		`ALTER TABLE handoffs ALTER COLUMN block SET NOT NULL, ALTER COLUMN status SET NOT NULL,
+			ALTER COLUMN reason SET DEFAULT '', ALTER COLUMN reason SET NOT NULL`,
+		"DELETE FROM work_cache WHERE work IS NULL OR time IS NULL",
+		"ALTER TABLE work_cache ALTER COLUMN work SET NOT NULL, ALTER COLUMN time SET NOT NULL",
+		"CREATE INDEX handoffs_status ON handoffs(status)",
+		"CREATE INDEX wallet_id ON wallet(id)",
+		"CREATE INDEX wallet_time ON wallet(time)",
+		"CREATE INDEX work_cache_time ON work_cache(time)",
+	},
+}, {
+	version:     3,
+	description: "free wallet index list",
+	sqlite: []string{
+		"CREATE INDEX wallet_free ON wallet(idx) WHERE id = ''",
+	},
+	postgres: []string{
+		"CREATE INDEX wallet_free ON wallet(idx) WHERE id = ''",
+	},
+}, {
+	version:     4,
+	description: "payment events",
+	sqlite: []string{
+		`CREATE TABLE events(seq INTEGER PRIMARY KEY AUTOINCREMENT, id TEXT NOT NULL, type TEXT NOT NULL, time INTEGER NOT NULL,
+			block_hash TEXT NOT NULL DEFAULT '', account TEXT NOT NULL DEFAULT '', amount TEXT NOT NULL DEFAULT '', reason TEXT NOT NULL DEFAULT '')`,
+		"CREATE INDEX events_id ON events(id)",
+	},
+	postgres: []string{
+		`CREATE TABLE events(seq BIGSERIAL PRIMARY KEY, id TEXT NOT NULL, type TEXT NOT NULL, time BIGINT NOT NULL,
+			block_hash TEXT NOT NULL DEFAULT '', account TEXT NOT NULL DEFAULT '', amount TEXT NOT NULL DEFAULT '', reason TEXT NOT NULL DEFAULT '')`,
+		"CREATE INDEX events_id ON events(id)",
+	},
+}, {
+	version:     5,
+	description: "closed payments and archive",
+	sqlite: []string{
+		"ALTER TABLE payments ADD COLUMN state TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE payments ADD COLUMN reason TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE payments ADD COLUMN closed_by TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE payments ADD COLUMN refunds TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE payments ADD COLUMN closed_at INTEGER",
+		"CREATE INDEX payments_closed_at ON payments(closed_at)",
+		`CREATE TABLE payments_archive(id TEXT PRIMARY KEY, account TEXT NOT NULL, amount TEXT NOT NULL, block_hash TEXT NOT NULL,
+			state TEXT NOT NULL, reason TEXT NOT NULL, closed_by TEXT NOT NULL, refunds TEXT NOT NULL, closed_at INTEGER NOT NULL)`,
+	},
+	postgres: []string{
+		"ALTER TABLE payments ADD COLUMN state TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE payments ADD COLUMN reason TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE payments ADD COLUMN closed_by TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE payments ADD COLUMN refunds TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE payments ADD COLUMN closed_at BIGINT",
+		"CREATE INDEX payments_closed_at ON payments(closed_at)",
+		`CREATE TABLE payments_archive(id TEXT PRIMARY KEY, account TEXT NOT NULL, amount TEXT NOT NULL, block_hash TEXT NOT NULL,
+			state TEXT NOT NULL, reason TEXT NOT NULL, closed_by TEXT NOT NULL, refunds TEXT NOT NULL, closed_at BIGINT NOT NULL)`,
+	},
+}, {
+	version:     6,
+	description: "journal of intermediate account movements",
+	sqlite: []string{
+		`CREATE TABLE journal(seq INTEGER PRIMARY KEY AUTOINCREMENT, id TEXT NOT NULL, kind TEXT NOT NULL, block_hash TEXT NOT NULL UNIQUE,
+			debit TEXT NOT NULL, credit TEXT NOT NULL, amount TEXT NOT NULL, time INTEGER NOT NULL)`,
+		"CREATE INDEX journal_id ON journal(id)",
+	},
+	postgres: []string{
+		`CREATE TABLE journal(seq BIGSERIAL PRIMARY KEY, id TEXT NOT NULL, kind TEXT NOT NULL, block_hash TEXT NOT NULL UNIQUE,
+			debit TEXT NOT NULL, credit TEXT NOT NULL, amount TEXT NOT NULL, time BIGINT NOT NULL)`,
+		"CREATE INDEX journal_id ON journal(id)",
+	},
+}, {
+	version:     7,
+	description: "undelivered callbacks",
+	sqlite: []string{
+		"CREATE TABLE callbacks(seq INTEGER PRIMARY KEY AUTOINCREMENT, id TEXT NOT NULL, body TEXT NOT NULL, attempts INTEGER NOT NULL, time INTEGER NOT NULL)",
+	},
+	postgres: []string{
+		"CREATE TABLE callbacks(seq BIGSERIAL PRIMARY KEY, id TEXT NOT NULL, body TEXT NOT NULL, attempts INTEGER NOT NULL, time BIGINT NOT NULL)",
+	},
+}}
+
+func applyMigrations() (err error) {
+	applied, err := store.migrate()
+	for _, version := range applied {
+		log.Printf("applied migration %d: %s", version, migrations[version-1].description)
+	}
+	return
+}
+
+func migrateCommand(args []string) (err error) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	status := fs.Bool("status", false, "List migrations without applying them")
+	fs.Parse(args)
+	if !*status {
+		if err = applyMigrations(); err != nil {
+			return
+		}
+	}
+	applied, err := store.appliedMigrations()
+	if err != nil {
+		return
+	}
+	for _, m := range migrations {
+		state := "pending"
+		if t, ok := applied[m.version]; ok {
+			state = "applied " + t.Format(time.RFC3339)
+		}
+		fmt.Printf("%3d  %-34s  %s\n", m.version, m.description, state)
+	}
+	return
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	errNodeUnavailable = errors.New("node unavailable")
+	rpcTimeouts        = map[string]time.Duration{
+		"process":       30 * time.Second,
+		"work_generate": 0,
+		"work_cancel":   5 * time.Second,
+	}
+	rpcIdempotent = map[string]bool{
+		"account_balance":    true,
+		"account_info":       true,
+		"accounts_balances":  true,
+		"accounts_frontiers": true,
+		"accounts_pending":   true,
+		"active_difficulty":  true,
+		"block_count":        true,
+		"block_info":         true,
+		"blocks_info":        true,
+		"successors":         true,
+		"version":            true,
+	}
+	breakers = struct {
+		m sync.Mutex
+		b map[string]*breaker
+	}{b: make(map[string]*breaker)}
+)
+
+type breaker struct {
+	failures int
+	open     time.Time
+	trial    bool
+}
+
+func getBreaker(url string) *breaker {
+	breakers.m.Lock()
+	defer breakers.m.Unlock()
+	b, ok := breakers.b[url]
+	if !ok {
+		b = &breaker{}
+		breakers.b[url] = b
+	}
+	return b
+}
+
+func (b *breaker) allow() bool {
+	breakers.m.Lock()
+	defer breakers.m.Unlock()
+	if b.failures < 5 {
+		return true
+	}
+	if time.Now().Before(b.open) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *breaker) record(err error) {
+	breakers.m.Lock()
+	defer breakers.m.Unlock()
+	b.trial = false
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	if b.failures++; b.failures >= 5 {
+		b.open = time.Now().Add(30 * time.Second)
+	}
+}
+
+// abandon gives up a trial call whose caller went away, without counting it
+// for or against the node.
+func (b *breaker) abandon() {
+	breakers.m.Lock()
+	defer breakers.m.Unlock()
+	b.trial = false
+}
+
+type nodeTransport struct{ http.RoundTripper }
+
+func (t nodeTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	url := req.URL.String()
+	if !isNodeURL(url) || req.Body == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return
+	}
+	req.Body.Close()
+	var v struct{ Action string }
+	json.Unmarshal(body, &v)
+	timeout, ok := rpcTimeouts[v.Action]
+	if !ok {
+		timeout = 10 * time.Second
+	}
+	attempts := 1
+	if rpcIdempotent[v.Action] {
+		attempts = 3
+	}
+	failover, _ := req.Context().Value(failoverKey{}).(bool)
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			backoff := time.Duration(100<<i)*time.Millisecond + time.Duration(rand.Int63n(int64(100*time.Millisecond)))
+			select {
+			case <-time.After(backoff):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+			if failover {
+				url = nodes.pick().url
+			}
+		}
+		b := getBreaker(url)
+		if !b.allow() {
+			if err = errNodeUnavailable; !failover {
+				return
+			}
+			continue
+		}
+		if resp, err = t.attempt(req, url, body, timeout); err == nil {
+			b.record(nil)
+			return
+		}
+		if req.Context().Err() != nil {
+			b.abandon()
+			return
+		}
+		b.record(err)
+		nodes.markDown(url)
+	}
+	return
+}
+
+func (t nodeTransport) attempt(req *http.Request, url string, body []byte, timeout time.Duration) (resp *http.Response, err error) {
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	req = req.Clone(ctx)
+	if req.URL, err = req.URL.Parse(url); err != nil {
+		return
+	}
+	req.Host = ""
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	if resp, err = t.RoundTripper.RoundTrip(req); err != nil {
+		traffic.RPC(req.URL.String(), body, nil, err)
+		return
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	traffic.RPC(req.URL.String(), body, data, err)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("node returned %s", resp.Status)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return
+}
+
+func isNodeURL(url string) bool {
+	for _, n := range nodes.nodes {
+		if n.url == url {
+			return true
+		}
+	}
+	for _, u := range quorumNodes {
+		if u == url {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakerTrialAbandoned(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+	url := srv.URL + "/"
+	defer func(p *nodePool) { nodes = p }(nodes)
+	nodes = &nodePool{nodes: []*node{{url: url}}, sticky: make(map[string]stickyNode)}
+	b := getBreaker(url)
+	b.failures, b.open = 5, time.Now().Add(-time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(`{"action":"process"}`))
+	if _, err := (nodeTransport{http.DefaultTransport}).RoundTrip(req); err == nil {
+		t.Fatal("expected the trial call to fail")
+	}
+	if !b.allow() {
+		t.Fatal("breaker stayed half-open after its trial call was cancelled")
+	}
+	if b.failures != 5 {
+		t.Fatalf("cancelled trial counted: %d failures", b.failures)
+	}
+}
+
+func TestIdempotentCallFailsOver(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"count":"2","unchecked":"0","cemented":"1"}`))
+	}))
+	defer up.Close()
+	defer func(p *nodePool) { nodes = p }(nodes)
+	nodes = &nodePool{
+		nodes:  []*node{{url: down.URL + "/", healthy: true}, {url: up.URL + "/", healthy: true}},
+		sticky: make(map[string]stickyNode),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, count, _, err := nodeClient(ctx).BlockCount(); err != nil || count != 2 {
+		t.Fatalf("block_count: %d, %v", count, err)
+	}
+	if nodes.nodes[0].isHealthy() {
+		t.Fatal("failed node still healthy")
+	}
+
+	nodes.nodes[0].healthy = true
+	block := `{"action":"process","block":{}}`
+	req, _ := http.NewRequestWithContext(poolContext(ctx), "POST", down.URL+"/", strings.NewReader(block))
+	if _, err := (nodeTransport{http.DefaultTransport}).RoundTrip(req); err == nil {
+		t.Fatal("process was sent to another node")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hectorchu/gonano/rpc"
+)
+
+// nodeBackend is the node RPC used by the payment flow. It is implemented
+// by *rpc.Client and by the in-memory ledger in package fakenode.
+type nodeBackend interface {
+	AccountInfo(account string) (rpc.AccountInfo, error)
+	AccountsPending(accounts []string, count int64) (map[string]rpc.HashToPendingMap, error)
+	BlockCount() (cemented, count, unchecked uint64, err error)
+	BlockInfo(hash rpc.BlockHash) (rpc.BlockInfo, error)
+	Process(block *rpc.Block, subtype string) (rpc.BlockHash, error)
+	Successors(block rpc.BlockHash, count int64) ([]rpc.BlockHash, error)
+}
+
+type node struct {
+	url, wsURL string
+	m          sync.Mutex
+	healthy    bool
+	count      uint64
+	cemented   uint64
+	version    string
+}
+
+func (n *node) isHealthy() bool {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return n.healthy
+}
+
+func (n *node) setHealthy(healthy bool) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if n.healthy != healthy {
+		if healthy {
+			log.Printf("node %s is healthy", n.url)
+		} else {
+			log.Printf("node %s is unhealthy", n.url)
+		}
+	}
+	n.healthy = healthy
+}
+
+type stickyNode struct {
+	n       *node
+	expires time.Time
+}
+
+type nodePool struct {
+	nodes  []*node
+	ws     []string
+	m      sync.Mutex
+	sticky map[string]stickyNode
+}
+
+var nodes *nodePool
+
+func initNodes() {
+	nodes = &nodePool{sticky: make(map[string]stickyNode)}
+	for _, url := range strings.Split(*rpcURL, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			nodes.nodes = append(nodes.nodes, &node{url: url})
+		}
+	}
+	for i, url := range strings.Split(*wsURL, ",") {
+		if url = strings.TrimSpace(url); url == "" {
+			continue
+		} else if i < len(nodes.nodes) {
+			nodes.nodes[i].wsURL = url
+		} else {
+			nodes.ws = append(nodes.ws, url)
+		}
+	}
+	// Keep enough idle connections to the nodes for concurrent requests,
+	// instead of the default two, which has them redialed under load.
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = 64
+	http.DefaultClient.Transport = nodeTransport{t}
+	expvar.Publish("nodes", expvar.Func(nodes.status))
+	nodes.probe()
+	go func() {
+		for range time.Tick(10 * time.Second) {
+			nodes.probe()
+		}
+	}()
+}
+
+func (p *nodePool) probe() {
+	var wg sync.WaitGroup
+	errs := make([]error, len(p.nodes))
+	for i, n := range p.nodes {
+		wg.Add(1)
+		go func(i int, n *node) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			client := rpc.Client{URL: n.url, Ctx: ctx}
+			cemented, count, _, err := client.BlockCount()
+			var v struct {
+				NodeVendor string `json:"node_vendor"`
+			}
+			if err == nil {
+				err = rpcCall(&client, map[string]interface{}{"action": "version"}, &v)
+			}
+			if errs[i] = err; err == nil {
+				n.m.Lock()
+				n.count, n.cemented, n.version = count, cemented, v.NodeVendor
+				n.m.Unlock()
+			}
+		}(i, n)
+	}
+	wg.Wait()
+	var max uint64
+	for i, n := range p.nodes {
+		if errs[i] == nil && n.count > max {
+			max = n.count
+		}
+	}
+	for i, n := range p.nodes {
+		if errs[i] != nil {
+			log.Print(errs[i])
+		}
+		n.setHealthy(errs[i] == nil && max-n.count <= *rpcMaxLag)
+	}
+	p.m.Lock()
+	for key, s := range p.sticky {
+		if time.Now().After(s.expires) {
+			delete(p.sticky, key)
+		}
+	}
+	p.m.Unlock()
+}
+
+func (p *nodePool) pick() *node {
+	for _, n := range p.nodes {
+		if n.isHealthy() {
+			return n
+		}
+	}
+	return p.nodes[0]
+}
+
+func (p *nodePool) pickSticky(key string) *node {
+	p.m.Lock()
+	defer p.m.Unlock()
+	s, ok := p.sticky[key]
+	if !ok || !s.n.isHealthy() {
+		s.n = p.pick()
+	}
+	s.expires = time.Now().Add(10 * time.Minute)
+	p.sticky[key] = s
+	return s.n
+}
+
+func (p *nodePool) wsURLs() (urls []string) {
+	for _, healthy := range []bool{true, false} {
+		for _, n := range p.nodes {
+			if n.wsURL != "" && n.isHealthy() == healthy {
+				urls = append(urls, n.wsURL)
+			}
+		}
+	}
+	return append(urls, p.ws...)
+}
+
+func (p *nodePool) markDown(url string) {
+	for _, n := range p.nodes {
+		if n.url == url {
+			n.setHealthy(false)
+		}
+	}
+}
+
+func (p *nodePool) status() interface{} {
+	status := make(map[string]interface{})
+	for _, n := range p.nodes {
+		n.m.Lock()
+		status[n.url] = map[string]interface{}{
+			"healthy":  n.healthy,
+			"count":    n.count,
+			"cemented": n.cemented,
+			"version":  n.version,
+		}
+		n.m.Unlock()
+	}
+	return status
+}
+
+// failoverKey marks the context of calls made through the pool, whose
+// idempotent calls are retried on another healthy node when theirs fails.
+// Calls addressed to one node in particular, such as probes and quorum
+// checks, never move.
+type failoverKey struct{}
+
+func poolContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, failoverKey{}, true)
+}
+
+func nodeClient(ctx context.Context) *rpc.Client {
+	return &rpc.Client{URL: nodes.pick().url, Ctx: poolContext(ctx)}
+}
+
+func stickyClient(ctx context.Context, key string) *rpc.Client {
+	return &rpc.Client{URL: nodes.pickSticky(key).url, Ctx: poolContext(ctx)}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hectorchu/gonano/util"
+	"github.com/hectorchu/nano-payment-server/fakenode"
+)
+
+var _ nodeBackend = (*fakenode.Node)(nil)
+
+var (
+	testNode      *fakenode.Node
+	testWallet    *Wallet
+	testServer    *httptest.Server
+	testCallbacks = make(chan map[string]string, 16)
+
+	// testRace, if set, runs once before the test node processes the next
+	// block of account testRaceAccount.
+	testRaceMutex   sync.Mutex
+	testRaceAccount string
+	testRace        func()
+)
+
+// raceProcess arranges for f to run just before the next block of account
+// reaches the test node, as if it had been published elsewhere first.
+func raceProcess(account string, f func()) {
+	testRaceMutex.Lock()
+	defer testRaceMutex.Unlock()
+	testRaceAccount, testRace = account, f
+}
+
+func serveTestNode(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	testRaceMutex.Lock()
+	var race func()
+	if testRace != nil && bytes.Contains(body, []byte(`"process"`)) && bytes.Contains(body, []byte(testRaceAccount)) {
+		race, testRace = testRace, nil
+	}
+	testRaceMutex.Unlock()
+	if race != nil {
+		race()
+	}
+	testNode.ServeHTTP(w, r)
+}
+
+// TestMain runs the server against an in-memory ledger served over the node
+// RPC and websocket protocols, with callbacks collected in testCallbacks.
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "nano-payment-server")
+	if err != nil {
+		log.Fatal(err)
+	}
+	code := func() int {
+		defer os.RemoveAll(dir)
+		if testNode, err = fakenode.New(make([]byte, 32)); err != nil {
+			log.Fatal(err)
+		}
+		node := httptest.NewServer(http.HandlerFunc(serveTestNode))
+		defer node.Close()
+		cb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var v map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&v); err == nil {
+				testCallbacks <- v
+			}
+		}))
+		defer cb.Close()
+		*dbPath = filepath.Join(dir, "test.db")
+		*rpcURL = node.URL
+		*wsURL = "ws" + strings.TrimPrefix(node.URL, "http")
+		*callbackURL = cb.URL
+		if err = initDB(); err != nil {
+			log.Fatal(err)
+		}
+		if err = applyMigrations(); err != nil {
+			log.Fatal(err)
+		}
+		initNodes()
+		initQuorum()
+		initWorkPeers()
+		if testWallet, err = loadWallet(); err != nil {
+			log.Fatal(err)
+		}
+		det, err := newDetector()
+		if err != nil {
+			log.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/payment/new", newPaymentHandler(testWallet, det))
+		mux.HandleFunc("/payment/wait", waitPaymentHandler(testWallet, det))
+		mux.HandleFunc("/payment/cancel", cancelPaymentHandler(testWallet))
+		mux.HandleFunc("/payment/pay", handoffPaymentHandler(testWallet, det))
+		mux.HandleFunc("/payment/status", statusPaymentHandler)
+		testServer = httptest.NewServer(mux)
+		defer testServer.Close()
+		return m.Run()
+	}()
+	os.Exit(code)
+}
+
+func postJSON(t *testing.T, path string, in, out interface{}) {
+	t.Helper()
+	body, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(testServer.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: %s: %s", path, resp.Status, data)
+	}
+	if err = json.Unmarshal(data, out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestPayment(t *testing.T, merchant, amount string) (id, account string) {
+	t.Helper()
+	var v struct{ ID, Account string }
+	postJSON(t, "/payment/new", map[string]string{"account": merchant, "amount": amount}, &v)
+	return v.ID, v.Account
+}
+
+func waitCallback(t *testing.T, id string) map[string]string {
+	t.Helper()
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case v := <-testCallbacks:
+			if v["id"] == id {
+				return v
+			}
+		case <-timeout:
+			t.Fatalf("no callback for payment %s", id)
+		}
+	}
+}
+
+func testAccount(t *testing.T, index uint32) (key []byte, address string) {
+	t.Helper()
+	key, err := fakenode.Key(bytes.Repeat([]byte{1}, 32), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address, err = fakenode.Address(key); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func nano(t *testing.T, amount string) *big.Int {
+	t.Helper()
+	n, err := util.NanoAmountFromString(amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n.Raw
+}
+
+func receivable(t *testing.T, address string) *big.Int {
+	t.Helper()
+	_, pending, err := testNode.AccountBalance(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pending.Int
+}
+
+func TestPaymentForwarded(t *testing.T) {
+	_, merchant := testAccount(t, 0)
+	before := receivable(t, merchant)
+	id, account := newTestPayment(t, merchant, "1")
+	if _, err := testNode.Send(testNode.Genesis(), account, nano(t, "1")); err != nil {
+		t.Fatal(err)
+	}
+	var wait struct {
+		ID        string
+		BlockHash string `json:"block_hash"`
+	}
+	postJSON(t, "/payment/wait", map[string]interface{}{"id": id, "timeout": 30}, &wait)
+	if wait.ID != id || wait.BlockHash == "" {
+		t.Fatalf("unexpected wait response %+v", wait)
+	}
+	if cb := waitCallback(t, id); cb["status"] != "completed" || cb["block_hash"] != wait.BlockHash {
+		t.Fatalf("unexpected callback %v", cb)
+	}
+	var status map[string]interface{}
+	postJSON(t, "/payment/status", map[string]string{"id": id}, &status)
+	if status["status"] != "completed" {
+		t.Fatalf("unexpected status %v", status)
+	}
+	if got := receivable(t, merchant); got.Sub(got, before).Cmp(nano(t, "1")) != 0 {
+		t.Fatalf("merchant received %s raw, want 1 nano", got)
+	}
+}
+
+func TestPaymentHandoff(t *testing.T) {
+	_, merchant := testAccount(t, 1)
+	before := receivable(t, merchant)
+	id, _ := newTestPayment(t, merchant, "1")
+	genesis, err := fakenode.Address(testNode.Genesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := testNode.AccountInfo(genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := util.AddressToPubkey(merchant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance := new(big.Int).Sub(&info.Balance.Int, nano(t, "1"))
+	block, err := testNode.SendBlock(testNode.Genesis(), info.Frontier, info.Representative, balance, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pay struct {
+		ID        string
+		BlockHash string `json:"block_hash"`
+	}
+	postJSON(t, "/payment/pay?id="+id, block, &pay)
+	hash, err := block.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pay.BlockHash != hash.String() {
+		t.Fatalf("handoff returned block %s, want %s", pay.BlockHash, hash)
+	}
+	if cb := waitCallback(t, id); cb["status"] != "completed" || cb["block_hash"] != hash.String() {
+		t.Fatalf("unexpected callback %v", cb)
+	}
+	if got := receivable(t, merchant); got.Sub(got, before).Cmp(nano(t, "1")) != 0 {
+		t.Fatalf("merchant received %s raw, want 1 nano", got)
+	}
+}
+
+func TestHandoffFork(t *testing.T) {
+	payer, address := testAccount(t, 4)
+	if _, err := testNode.Send(testNode.Genesis(), address, nano(t, "3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := testNode.ReceivePendings(payer); err != nil {
+		t.Fatal(err)
+	}
+	_, merchant := testAccount(t, 5)
+	id, _ := newTestPayment(t, merchant, "1")
+	info, err := testNode.AccountInfo(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := util.AddressToPubkey(merchant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := testNode.SendBlock(payer, info.Frontier, info.Representative, new(big.Int).Sub(&info.Balance.Int, nano(t, "1")), link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	competing, err := testNode.SendBlock(payer, info.Frontier, info.Representative, new(big.Int).Sub(&info.Balance.Int, nano(t, "2")), link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raceProcess(address, func() {
+		if _, err := testNode.Process(competing, "send"); err != nil {
+			t.Error(err)
+		}
+	})
+	body, err := json.Marshal(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(testServer.URL+"/payment/pay?id="+id, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("handoff of a forked block: %s", resp.Status)
+	}
+	hash, err := block.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cb := waitCallback(t, id); cb["status"] != "failed" || cb["reason"] == "" || cb["block_hash"] != hash.String() {
+		t.Fatalf("unexpected callback %v", cb)
+	}
+	var status map[string]interface{}
+	postJSON(t, "/payment/status", map[string]string{"id": id}, &status)
+	if status["status"] != "failed" || status["reason"] == nil {
+		t.Fatalf("unexpected status %v", status)
+	}
+}
+
+func TestScavengerRefund(t *testing.T) {
+	payer, address := testAccount(t, 2)
+	if _, err := testNode.Send(testNode.Genesis(), address, nano(t, "3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := testNode.ReceivePendings(payer); err != nil {
+		t.Fatal(err)
+	}
+	_, merchant := testAccount(t, 3)
+	id, account := newTestPayment(t, merchant, "5")
+	if _, err := testNode.Send(payer, account, nano(t, "2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := scavenge(testWallet, id); err != nil {
+		t.Fatal(err)
+	}
+	payment, err := store.getPaymentRequest(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.state != "expired" || payment.closedBy != "scavenger" || len(payment.refunds) != 1 {
+		t.Fatalf("payment %s state %q closed by %q with %d refunds", id, payment.state, payment.closedBy, len(payment.refunds))
+	}
+	if got := receivable(t, address); got.Cmp(nano(t, "2")) != 0 {
+		t.Fatalf("payer receivable %s raw, want 2 nano", got)
+	}
+	if got := receivable(t, merchant); got.Sign() != 0 {
+		t.Fatalf("merchant receivable %s raw, want nothing", got)
+	}
+	if _, err := store.getWalletIndex(id); err == nil {
+		t.Fatal("wallet index not freed")
+	}
+	bi, err := testNode.BlockInfo(payment.refunds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bi.Contents.LinkAsAccount != address {
+		t.Fatalf("refund sent to %s, want %s", bi.Contents.LinkAsAccount, address)
+	}
+}
+
+func TestCancelAfterForward(t *testing.T) {
+	_, merchant := testAccount(t, 6)
+	before := receivable(t, merchant)
+	id, account := newTestPayment(t, merchant, "1")
+
+	// Stop the watcher and forward as if it had been stopped with its
+	// forward already accepted by the node.
+	watchers.hold(id)
+	send, err := testNode.Send(testNode.Genesis(), account, nano(t, "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := store.getWalletIndex(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := testWallet.getAccount(context.Background(), index, priorityForward)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.ReceivePending(send); err != nil {
+		t.Fatal(err)
+	}
+	forward, err := a.Send(merchant, nano(t, "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchers.release(id)
+
+	if err = cancel(context.Background(), testWallet, id, "cancelled", "test", "api"); err == nil {
+		t.Fatal("payment cancelled after its forward")
+	}
+	if cb := waitCallback(t, id); cb["status"] != "completed" || cb["block_hash"] != forward.String() {
+		t.Fatalf("unexpected callback %v", cb)
+	}
+	payment, err := store.getPaymentRequest(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.state != "" || !bytes.Equal(payment.hash, forward) || len(payment.refunds) != 0 {
+		t.Fatalf("payment %s state %q hash %s with %d refunds", id, payment.state, payment.hash, len(payment.refunds))
+	}
+	if got := receivable(t, merchant); got.Sub(got, before).Cmp(nano(t, "1")) != 0 {
+		t.Fatalf("merchant received %s raw, want 1 nano", got)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	pollMinInterval = time.Second
+	pollMaxInterval = 30 * time.Second
+)
+
+type pollMux struct {
+	m       sync.Mutex
+	running bool
+	subs    subscriptions
+	state   map[string]*pollState
+}
+
+type pollState struct {
+	seen     map[string]bool
+	interval time.Duration
+	next     time.Time
+}
+
+func newPollMux() *pollMux {
+	return &pollMux{
+		subs:  make(subscriptions),
+		state: make(map[string]*pollState),
+	}
+}
+
+func (p *pollMux) connect(account string) (sub *subscription, err error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	sub = newSubscription(account)
+	if p.subs.add(sub) {
+		p.state[account] = &pollState{
+			seen:     make(map[string]bool),
+			interval: pollMinInterval,
+			next:     time.Now(),
+		}
+	}
+	if !p.running {
+		p.running = true
+		go p.run()
+	}
+	return
+}
+
+func (p *pollMux) disconnect(sub *subscription) {
+	p.m.Lock()
+	if p.subs.remove(sub) {
+		delete(p.state, sub.account)
+	}
+	p.m.Unlock()
+}
+
+func (p *pollMux) run() {
+	for range time.Tick(pollMinInterval / 4) {
+		var due []string
+		now := time.Now()
+		p.m.Lock()
+		for account, state := range p.state {
+			if now.After(state.next) {
+				due = append(due, account)
+			}
+		}
+		p.m.Unlock()
+		if len(due) > 0 {
+			p.poll(due)
+		}
+	}
+}
+
+func (p *pollMux) poll(accounts []string) {
+	events, err := ledgerEvents(nodeClient(context.Background()), accounts)
+	if err != nil {
+		log.Print(err)
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	seen := make(map[string]map[string]bool)
+	changed := make(map[string]bool)
+	for _, m := range events {
+		account := m.Block.Account
+		if _, ok := p.state[account]; !ok {
+			account = m.Block.LinkAsAccount
+		}
+		state, ok := p.state[account]
+		if !ok {
+			continue
+		}
+		if seen[account] == nil {
+			seen[account] = make(map[string]bool)
+		}
+		hash := m.Hash.String()
+		seen[account][hash] = true
+		if !state.seen[hash] {
+			changed[account] = true
+			p.subs.dispatch(m)
+		}
+	}
+	now := time.Now()
+	for _, account := range accounts {
+		state, ok := p.state[account]
+		if !ok {
+			continue
+		}
+		if err == nil {
+			state.seen = seen[account]
+		}
+		if changed[account] {
+			state.interval = pollMinInterval
+		} else if state.interval = state.interval * 3 / 2; state.interval > pollMaxInterval {
+			state.interval = pollMaxInterval
+		}
+		state.next = now.Add(state.interval)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"expvar"
+	"math/rand"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/hectorchu/gonano/rpc"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	priorityHandoff = iota
+	priorityForward
+	priorityRefund
+	priorityPrecompute
+)
+
+var (
+	powMetrics      = expvar.NewMap("pow")
+	powQueueDepth   = new(expvar.Int)
+	powRunning      = new(expvar.Int)
+	powCompleted    = new(expvar.Int)
+	powCancelled    = new(expvar.Int)
+	powLatencyLast  = new(expvar.Float)
+	powLatencyTotal = new(expvar.Float)
+	cpuEngine       = newPowEngine(runtime.NumCPU())
+)
+
+func init() {
+	powMetrics.Set("queue_depth", powQueueDepth)
+	powMetrics.Set("running", powRunning)
+	powMetrics.Set("jobs_completed", powCompleted)
+	powMetrics.Set("jobs_cancelled", powCancelled)
+	powMetrics.Set("latency_seconds_last", powLatencyLast)
+	powMetrics.Set("latency_seconds_total", powLatencyTotal)
+}
+
+type powJob struct {
+	root       rpc.BlockHash
+	difficulty []byte
+	priority   int
+	seq        uint64
+	index      int
+	waiters    int
+	queued     time.Time
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan struct{}
+	work       rpc.HexData
+	err        error
+}
+
+type powQueue []*powJob
+
+func (q powQueue) Len() int { return len(q) }
+
+func (q powQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q powQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+
+func (q *powQueue) Push(x interface{}) {
+	job := x.(*powJob)
+	job.index = len(*q)
+	*q = append(*q, job)
+}
+
+func (q *powQueue) Pop() interface{} {
+	old := *q
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	job.index = -1
+	*q = old[:len(old)-1]
+	return job
+}
+
+type powEngine struct {
+	m    sync.Mutex
+	c    *sync.Cond
+	q    powQueue
+	jobs map[string]*powJob
+	seq  uint64
+}
+
+func newPowEngine(workers int) (e *powEngine) {
+	e = &powEngine{jobs: make(map[string]*powJob)}
+	e.c = sync.NewCond(&e.m)
+	for i := 0; i < workers; i++ {
+		go e.worker()
+	}
+	return
+}
+
+func (e *powEngine) generate(
+	ctx context.Context, root rpc.BlockHash, difficulty []byte, priority int,
+) (work rpc.HexData, err error) {
+	for {
+		job := e.enqueue(root, difficulty, priority)
+		select {
+		case <-job.done:
+			if job.err != nil || validateWork(root, job.work, difficulty) {
+				return job.work, job.err
+			}
+		case <-ctx.Done():
+			e.m.Lock()
+			if job.waiters--; job.waiters == 0 && job.index >= 0 {
+				heap.Remove(&e.q, job.index)
+				e.finish(job, nil, ctx.Err())
+			} else if job.waiters == 0 {
+				job.cancel()
+			}
+			e.m.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (e *powEngine) enqueue(root rpc.BlockHash, difficulty []byte, priority int) (job *powJob) {
+	key := root.String()
+	e.m.Lock()
+	defer e.m.Unlock()
+	job, ok := e.jobs[key]
+	if !ok {
+		e.seq++
+		job = &powJob{
+			root:       root,
+			difficulty: difficulty,
+			priority:   priority,
+			seq:        e.seq,
+			queued:     time.Now(),
+			done:       make(chan struct{}),
+		}
+		job.ctx, job.cancel = context.WithCancel(context.Background())
+		e.jobs[key] = job
+		heap.Push(&e.q, job)
+		powQueueDepth.Set(int64(len(e.q)))
+		e.c.Signal()
+	} else if job.index >= 0 {
+		if bytes.Compare(difficulty, job.difficulty) > 0 {
+			job.difficulty = difficulty
+		}
+		if priority < job.priority {
+			job.priority = priority
+			heap.Fix(&e.q, job.index)
+		}
+	}
+	job.waiters++
+	return
+}
+
+func (e *powEngine) finish(job *powJob, work rpc.HexData, err error) {
+	job.work, job.err = work, err
+	if key := job.root.String(); e.jobs[key] == job {
+		delete(e.jobs, key)
+	}
+	job.cancel()
+	close(job.done)
+	powQueueDepth.Set(int64(len(e.q)))
+	if err != nil {
+		powCancelled.Add(1)
+		return
+	}
+	latency := time.Since(job.queued).Seconds()
+	powCompleted.Add(1)
+	powLatencyLast.Set(latency)
+	powLatencyTotal.Add(latency)
+}
+
+func (e *powEngine) worker() {
+	e.m.Lock()
+	defer e.m.Unlock()
+	for {
+		for len(e.q) == 0 {
+			e.c.Wait()
+		}
+		job := heap.Pop(&e.q).(*powJob)
+		powQueueDepth.Set(int64(len(e.q)))
+		powRunning.Add(1)
+		e.m.Unlock()
+		work, err := generateCPU(job.ctx, job.root, binary.BigEndian.Uint64(job.difficulty))
+		e.m.Lock()
+		powRunning.Add(-1)
+		e.finish(job, work, err)
+	}
+}
+
+func generateCPU(ctx context.Context, root rpc.BlockHash, target uint64) (work rpc.HexData, err error) {
+	h, err := blake2b.New(8, nil)
+	if err != nil {
+		return
+	}
+	b := make([]byte, 8)
+	for x := rand.Uint64(); ; x++ {
+		if x&0xffff == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		binary.LittleEndian.PutUint64(b, x)
+		h.Reset()
+		h.Write(b)
+		h.Write(root)
+		if binary.LittleEndian.Uint64(h.Sum(nil)) >= target {
+			work = make(rpc.HexData, 8)
+			binary.BigEndian.PutUint64(work, x)
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hectorchu/gonano/rpc"
+)
+
+var (
+	quorumNodes         []string
+	quorumDisagreements = expvar.NewInt("quorum_disagreements")
+)
+
+func initQuorum() {
+	for _, url := range strings.Split(*quorumURL, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			quorumNodes = append(quorumNodes, url)
+		}
+	}
+	if *quorum > len(quorumNodes) {
+		log.Fatalf("quorum of %d exceeds the %d quorum nodes", *quorum, len(quorumNodes))
+	}
+}
+
+// quorumLagAlert is how long quorum nodes may disagree on whether a block is
+// confirmed before it is treated as more than propagation lag.
+const quorumLagAlert = 5 * time.Minute
+
+func waitQuorum(ctx context.Context, hash rpc.BlockHash) (err error) {
+	if *quorum == 0 {
+		return
+	}
+	var lagSince time.Time
+	for {
+		var lagging bool
+		if lagging, err = checkQuorum(ctx, hash); err == nil {
+			return
+		}
+		log.Print(err)
+		switch {
+		case !lagging:
+			lagSince = time.Time{}
+		case lagSince.IsZero():
+			lagSince = time.Now()
+		case time.Since(lagSince) > quorumLagAlert:
+			quorumDisagreements.Add(1)
+			log.Printf("ALERT: quorum nodes still disagree on whether block %s is confirmed after %s", hash, quorumLagAlert)
+			lagSince = time.Now()
+		}
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// checkQuorum reports whether enough quorum nodes have confirmed the block.
+// Nodes confirming different balances, or one having cemented a different
+// block for the same root, are alerted on straight away; nodes which have
+// merely not confirmed the block yet are reported as lagging.
+func checkQuorum(ctx context.Context, hash rpc.BlockHash) (lagging bool, err error) {
+	var (
+		wg        sync.WaitGroup
+		m         sync.Mutex
+		confirmed int
+		balances  = make(map[string]bool)
+		block     *rpc.Block
+		behind    []string
+		forks     int
+	)
+	for _, url := range quorumNodes {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			client := rpc.Client{URL: url, Ctx: ctx}
+			bi, err := client.BlockInfo(hash)
+			m.Lock()
+			defer m.Unlock()
+			if err == nil && bi.Confirmed {
+				confirmed++
+				balances[bi.Balance.String()] = true
+				block = bi.Contents
+			} else {
+				behind = append(behind, url)
+			}
+		}(url)
+	}
+	wg.Wait()
+	if block != nil {
+		for _, url := range behind {
+			wg.Add(1)
+			go func(url string) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				defer cancel()
+				_, err := checkConfirmation(&rpc.Client{URL: url, Ctx: ctx}, block, hash)
+				if _, ok := err.(*forkError); ok {
+					m.Lock()
+					forks++
+					m.Unlock()
+				}
+			}(url)
+		}
+		wg.Wait()
+	}
+	if len(balances) > 1 || forks > 0 {
+		quorumDisagreements.Add(1)
+		log.Printf(
+			"ALERT: quorum nodes conflict on block %s: %d confirmed, %d distinct balances, %d cemented another block",
+			hash, confirmed, len(balances), forks,
+		)
+		return false, fmt.Errorf("quorum nodes conflict on block %s", hash)
+	}
+	lagging = confirmed > 0 && len(behind) > 0
+	if confirmed < *quorum {
+		return lagging, fmt.Errorf("block %s confirmed by %d of %d quorum nodes, need %d", hash, confirmed, len(quorumNodes), *quorum)
+	}
+	return
+}
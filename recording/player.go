@@ -0,0 +1,218 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// periodic actions are polled on timers, so how often they are called
+// during a replay says nothing about progress through the recording.
+var periodic = map[string]bool{
+	"active_difficulty": true,
+	"block_count":       true,
+	"version":           true,
+	"work_cancel":       true,
+}
+
+// Player serves a recording over the node RPC and websocket protocols.
+//
+// RPC requests are answered with the recorded responses to the same
+// request, in recorded order; once those run out the last one is repeated.
+// Proof-of-work is ignored when matching requests. Websocket messages are
+// released in recorded order, each once every RPC exchange recorded before
+// it has been replayed, or after MaxWait if the replay has diverged.
+type Player struct {
+	MaxWait time.Duration
+
+	m       sync.Mutex
+	cond    *sync.Cond
+	rpc     map[string][]*Entry
+	last    map[string]*Entry
+	pending map[uint64]bool
+	ws      []*Entry
+	wsNext  int
+}
+
+// Open loads a recording.
+func Open(path string) (p *Player, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	p = &Player{
+		MaxWait: 5 * time.Second,
+		rpc:     make(map[string][]*Entry),
+		last:    make(map[string]*Entry),
+		pending: make(map[uint64]bool),
+	}
+	p.cond = sync.NewCond(&p.m)
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 64<<20)
+	for s.Scan() {
+		var e Entry
+		if err = json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		switch e.Kind {
+		case "rpc":
+			action, key := requestKey(e.Request)
+			p.rpc[key] = append(p.rpc[key], &e)
+			if !periodic[action] {
+				p.pending[e.Seq] = true
+			}
+		case "ws":
+			p.ws = append(p.ws, &e)
+		}
+	}
+	if err = s.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(p.ws, func(i, j int) bool { return p.ws[i].Seq < p.ws[j].Seq })
+	return
+}
+
+func stripWork(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		delete(v, "work")
+		for _, v := range v {
+			stripWork(v)
+		}
+	case []interface{}:
+		for _, v := range v {
+			stripWork(v)
+		}
+	}
+}
+
+func requestKey(req []byte) (action, key string) {
+	var v map[string]interface{}
+	if json.Unmarshal(req, &v) != nil {
+		return "", string(req)
+	}
+	action, _ = v["action"].(string)
+	stripWork(v)
+	data, _ := json.Marshal(v)
+	return action, string(data)
+}
+
+func (p *Player) next(req []byte) *Entry {
+	p.m.Lock()
+	defer p.m.Unlock()
+	_, key := requestKey(req)
+	queue := p.rpc[key]
+	if len(queue) == 0 {
+		return p.last[key]
+	}
+	e := queue[0]
+	p.rpc[key], p.last[key] = queue[1:], e
+	delete(p.pending, e.Seq)
+	p.cond.Broadcast()
+	return e
+}
+
+func (p *Player) ready(seq uint64) bool {
+	for s := range p.pending {
+		if s < seq {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP answers RPC requests and serves websocket upgrades.
+func (p *Player) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		p.serveWS(w, r)
+		return
+	}
+	var req json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	e := p.next(req)
+	switch {
+	case e == nil:
+		log.Printf("replay: no recorded response to %s", req)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not recorded"})
+	case e.Error != "":
+		if h, ok := w.(http.Hijacker); ok {
+			if c, _, err := h.Hijack(); err == nil {
+				c.Close()
+				return
+			}
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(e.Response)
+	}
+}
+
+var upgrader = websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+
+func (p *Player) serveWS(w http.ResponseWriter, r *http.Request) {
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				close(closed)
+				p.cond.Broadcast()
+				return
+			}
+		}
+	}()
+	for {
+		timeout := time.AfterFunc(p.MaxWait, p.cond.Broadcast)
+		deadline := time.Now().Add(p.MaxWait)
+		p.m.Lock()
+		if p.wsNext == len(p.ws) {
+			p.m.Unlock()
+			timeout.Stop()
+			break
+		}
+		e := p.ws[p.wsNext]
+		for !p.ready(e.Seq) && time.Now().Before(deadline) && !isClosed(closed) {
+			p.cond.Wait()
+		}
+		if isClosed(closed) {
+			p.m.Unlock()
+			timeout.Stop()
+			return
+		}
+		if !p.ready(e.Seq) {
+			log.Printf("replay: releasing websocket message %d before the exchanges recorded ahead of it", e.Seq)
+		}
+		p.wsNext++
+		p.m.Unlock()
+		timeout.Stop()
+		if err = c.WriteMessage(websocket.TextMessage, e.Response); err != nil {
+			return
+		}
+	}
+	<-closed
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,178 @@
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// overpayment.jsonl was recorded from the payment server running against
+// cmd/fakenode: a payment of 1 nano is paid 2 nano, the excess is refunded
+// and the rest forwarded to the merchant.
+const fixture = "testdata/overpayment.jsonl"
+
+func loadFixture(t *testing.T) (entries []*Entry) {
+	t.Helper()
+	f, err := os.Open(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 64<<20)
+	for s.Scan() {
+		var e Entry
+		if err = json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, &e)
+	}
+	if err = s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func startPlayer(t *testing.T) *httptest.Server {
+	t.Helper()
+	p, err := Open(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.MaxWait = time.Minute
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func post(t *testing.T, url string, req []byte) []byte {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", bytes.NewReader(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.TrimSpace(data)
+}
+
+// withOtherWork replaces the proof-of-work of a process request, which
+// differs between runs.
+func withOtherWork(t *testing.T, req []byte) []byte {
+	t.Helper()
+	var v map[string]interface{}
+	if err := json.Unmarshal(req, &v); err != nil {
+		t.Fatal(err)
+	}
+	block, ok := v["block"].(map[string]interface{})
+	if !ok {
+		return req
+	}
+	block["work"] = "0123456789abcdef"
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReplay(t *testing.T) {
+	entries := loadFixture(t)
+	srv := startPlayer(t)
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// requested is the sequence number of the last recorded exchange
+	// replayed, read by the websocket reader on each message.
+	var requested uint64
+	type message struct {
+		data      []byte
+		requested uint64
+	}
+	messages := make(chan message, len(entries))
+	go func() {
+		defer close(messages)
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			messages <- message{data, atomic.LoadUint64(&requested)}
+		}
+	}()
+
+	var ws []*Entry
+	for _, e := range entries {
+		if e.Kind == "ws" {
+			ws = append(ws, e)
+			continue
+		}
+		atomic.StoreUint64(&requested, e.Seq)
+		if resp := post(t, srv.URL, withOtherWork(t, e.Request)); !bytes.Equal(resp, e.Response) {
+			t.Fatalf("exchange %d: got %s, want %s", e.Seq, resp, e.Response)
+		}
+	}
+	for _, e := range ws {
+		var m message
+		select {
+		case m = <-messages:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("websocket message %d was not released", e.Seq)
+		}
+		if !bytes.Equal(m.data, e.Response) {
+			t.Fatalf("websocket message %d: got %s, want %s", e.Seq, m.data, e.Response)
+		}
+		for _, r := range entries {
+			if r.Kind == "rpc" && r.Seq < e.Seq && !periodic[action(t, r)] && r.Seq > m.requested {
+				t.Fatalf("websocket message %d released before exchange %d was replayed", e.Seq, r.Seq)
+			}
+		}
+	}
+}
+
+func action(t *testing.T, e *Entry) string {
+	t.Helper()
+	var v struct{ Action string }
+	if err := json.Unmarshal(e.Request, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v.Action
+}
+
+func TestReplayRepeatsAndRefuses(t *testing.T) {
+	entries := loadFixture(t)
+	srv := startPlayer(t)
+	var last *Entry
+	for _, e := range entries {
+		if e.Kind == "rpc" && action(t, e) == "process" {
+			post(t, srv.URL, e.Request)
+			last = e
+		}
+	}
+	if last == nil {
+		t.Fatal("no process requests in the fixture")
+	}
+	if resp := post(t, srv.URL, last.Request); !bytes.Equal(resp, last.Response) {
+		t.Fatalf("repeated request: got %s, want %s", resp, last.Response)
+	}
+	resp := post(t, srv.URL, []byte(`{"action":"block_info","hash":"0000000000000000000000000000000000000000000000000000000000000000"}`))
+	if string(resp) != `{"error":"Not recorded"}` {
+		t.Fatalf("unrecorded request: got %s", resp)
+	}
+}
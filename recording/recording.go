@@ -0,0 +1,86 @@
+// Package recording records node RPC and websocket traffic to a file and
+// serves recordings back in the order they were recorded.
+package recording
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entry is one recorded RPC exchange or websocket message. Entries are
+// stored one per line as JSON.
+type Entry struct {
+	Seq      uint64          `json:"seq"`
+	Time     time.Time       `json:"time"`
+	Kind     string          `json:"kind"`
+	URL      string          `json:"url"`
+	Request  json.RawMessage `json:"request,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// Writer appends entries to a recording. A nil *Writer records nothing.
+type Writer struct {
+	m   sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+	seq uint64
+}
+
+// Create opens a recording for appending.
+func Create(path string) (w *Writer, err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	return &Writer{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func raw(data []byte) json.RawMessage {
+	if data == nil {
+		return nil
+	}
+	if json.Valid(data) {
+		return data
+	}
+	s, _ := json.Marshal(string(data))
+	return s
+}
+
+func (w *Writer) write(e *Entry) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.seq++
+	e.Seq, e.Time = w.seq, time.Now()
+	w.enc.Encode(e)
+}
+
+// RPC records a request to url and its response or error.
+func (w *Writer) RPC(url string, req, resp []byte, err error) {
+	if w == nil {
+		return
+	}
+	e := &Entry{Kind: "rpc", URL: url, Request: raw(req), Response: raw(resp)}
+	if err != nil {
+		e.Response, e.Error = nil, err.Error()
+	}
+	w.write(e)
+}
+
+// WS records a message received from the websocket at url.
+func (w *Writer) WS(url string, msg []byte) {
+	if w == nil {
+		return
+	}
+	w.write(&Entry{Kind: "ws", URL: url, Response: raw(msg)})
+}
+
+// Close closes the recording.
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	return w.f.Close()
+}
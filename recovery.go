@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/hectorchu/gonano/rpc"
+	"github.com/hectorchu/gonano/util"
+)
+
+func recoverPayments(wallet *Wallet, det detector) {
+	handoffs, err := store.getPendingHandoffs()
+	if err != nil {
+		log.Print(err)
+	}
+	for id, data := range handoffs {
+		if err = recoverHandoff(id, data); err != nil {
+			log.Printf("recovery: payment %s: %v", id, err)
+		}
+	}
+	allocations, err := store.getWalletAllocations()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, wa := range allocations {
+		if err = recoverAllocation(wallet, det, wa); err != nil {
+			log.Printf("recovery: payment %s: %v", wa.id, err)
+		}
+	}
+}
+
+func recoverHandoff(id, data string) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var block rpc.Block
+	if err = json.Unmarshal([]byte(data), &block); err != nil {
+		return
+	}
+	hash, err := block.Hash()
+	if err != nil {
+		return
+	}
+	client := stickyClient(ctx, block.Account)
+	if _, err = client.BlockInfo(hash); err != nil {
+		if err.Error() != "Block not found" {
+			return
+		}
+		log.Printf("recovery: payment %s: handoff block %s was not published, publishing", id, hash)
+		if err = sendBlock(ctx, &block); err != nil {
+			if err.Error() == "Fork" {
+				log.Printf("recovery: payment %s: handoff block %s forks, failing payment", id, hash)
+				return failHandoff(id, hash, "fork: a competing block was published for the same previous block")
+			}
+			return
+		}
+	}
+	log.Printf("recovery: payment %s: monitoring handoff block %s", id, hash)
+	if err = store.freeWalletIndex(id); err != nil {
+		return
+	}
+	go monitorHandoff(id, &block, hash)
+	return
+}
+
+func recoverAllocation(wallet *Wallet, det detector, wa walletAllocation) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	payment, err := store.getPaymentRequest(wa.id)
+	if err == sql.ErrNoRows {
+		log.Printf("recovery: payment %s: no payment record for wallet index %d, refunding", wa.id, wa.index)
+		a, err := wallet.getAccount(ctx, wa.index, priorityRefund)
+		if err != nil {
+			return err
+		}
+		if _, err = refund(ctx, wa.id, a); err != nil {
+			return err
+		}
+		return store.freeWalletIndex(wa.id)
+	} else if err != nil {
+		return
+	}
+	if payment.hash != nil {
+		log.Printf("recovery: payment %s: already completed with block %s, freeing wallet index %d", wa.id, payment.hash, wa.index)
+		return store.freeWalletIndex(wa.id)
+	}
+	if payment.state != "" {
+		log.Printf("recovery: payment %s: already %s, freeing wallet index %d", wa.id, payment.state, wa.index)
+		return store.freeWalletIndex(wa.id)
+	}
+	a, err := wallet.getAccount(ctx, wa.index, priorityForward)
+	if err != nil {
+		return
+	}
+	hash, err := findForward(ctx, a.Address(), payment, wa.time)
+	if err != nil {
+		return
+	}
+	if hash != nil {
+		log.Printf("recovery: payment %s: found unrecorded forward %s, completing", wa.id, hash)
+		if err = store.updatePaymentRequest(wa.id, a.Address(), hash); err != nil {
+			return
+		}
+		if err = store.freeWalletIndex(wa.id); err != nil {
+			return
+		}
+		return postCallback(map[string]string{
+			"id":         wa.id,
+			"block_hash": hash.String(),
+			"status":     "completed",
+		})
+	}
+	log.Printf("recovery: payment %s: resuming watch of %s", wa.id, a.Address())
+	watchers.start(wallet, det, wa.id)
+	return
+}
+
+func findForward(ctx context.Context, address string, payment *paymentRecord, since time.Time) (hash rpc.BlockHash, err error) {
+	link, err := util.AddressToPubkey(payment.account)
+	if err != nil {
+		return
+	}
+	client := stickyClient(ctx, address)
+	ai, err := client.AccountInfo(address)
+	if err != nil {
+		if err.Error() == "Account not found" {
+			err = nil
+		}
+		return
+	}
+	for hash := ai.Frontier; hash != nil; {
+		bi, err := client.BlockInfo(hash)
+		if err != nil {
+			return nil, err
+		}
+		if time.Unix(int64(bi.LocalTimestamp), 0).Before(since) {
+			break
+		}
+		if bi.Subtype == "send" && bytes.Equal(bi.Contents.Link, link) && bi.Amount.Cmp(payment.amount.Raw) == 0 {
+			return hash, nil
+		}
+		if bi.Height <= 1 {
+			break
+		}
+		hash = bi.Contents.Previous
+	}
+	return nil, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/hectorchu/gonano/rpc"
+)
+
+type confirmedAccountInfo struct {
+	rpc.AccountInfo
+	ConfirmedBalance  *rpc.RawAmount `json:"confirmed_balance"`
+	ConfirmedHeight   uint64         `json:"confirmed_height,string"`
+	ConfirmedFrontier rpc.BlockHash  `json:"confirmed_frontier"`
+}
+
+func rpcCall(client *rpc.Client, body map[string]interface{}, v interface{}) (err error) {
+	var buf bytes.Buffer
+	if err = json.NewEncoder(&buf).Encode(body); err != nil {
+		return
+	}
+	ctx := client.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.URL, &buf)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if client.AuthHeader != "" {
+		req.Header.Set("Authorization", client.AuthHeader)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var data json.RawMessage
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return
+	}
+	var e struct{ Error, Message string }
+	if err = json.Unmarshal(data, &e); err != nil {
+		return
+	}
+	if e.Error != "" {
+		return errors.New(e.Error)
+	} else if e.Message != "" {
+		return errors.New(e.Message)
+	}
+	return json.Unmarshal(data, v)
+}
+
+func accountInfoConfirmed(client *rpc.Client, account string) (info confirmedAccountInfo, err error) {
+	err = rpcCall(client, map[string]interface{}{
+		"action":            "account_info",
+		"account":           account,
+		"include_confirmed": true,
+	}, &info)
+	return
+}
@@ -1,14 +1,31 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"log"
 	"time"
 )
 
 func scavenger(wallet *Wallet) {
 	for range time.Tick(time.Minute) {
-		ids, err := getWalletIndexesOlderThan(time.Now().Add(-time.Hour))
+		if err := store.deleteCachedWorkOlderThan(time.Now().Add(-24 * time.Hour)); err != nil {
+			log.Print(err)
+		}
+		if *retention > 0 {
+			n, err := store.retirePaymentRequests(time.Now().AddDate(0, 0, -*retention), *retentionPurge)
+			if err != nil {
+				log.Print(err)
+			} else if n > 0 && *retentionPurge {
+				log.Printf("purged %d closed payments", n)
+			} else if n > 0 {
+				log.Printf("archived %d closed payments", n)
+			}
+		}
+		resumeHandoffs()
+		retryCallbacks()
+		ids, err := store.getWalletIndexesOlderThan(time.Now().Add(-time.Hour))
 		if err != nil {
 			log.Print(err)
 			continue
@@ -26,29 +43,72 @@ func scavenge(wallet *Wallet, id string) (err error) {
 		return
 	}
 	defer paymentMutex.unlock(id)
-	payment, err := getPaymentRequest(id)
+	payment, err := store.getPaymentRequest(id)
 	if err == sql.ErrNoRows {
 		return nil
-	} else if err != nil || payment.hash != nil {
+	} else if err != nil || payment.hash != nil || payment.state != "" {
 		return
 	}
-	return cancel(wallet, id)
+	ctx, stop := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer stop()
+	return cancel(ctx, wallet, id, "expired", "not paid within an hour", "scavenger")
 }
 
-func cancel(wallet *Wallet, id string) (err error) {
-	index, err := getWalletIndex(id)
+func cancel(ctx context.Context, wallet *Wallet, id, state, reason, closedBy string) (err error) {
+	watchers.hold(id)
+	defer watchers.release(id)
+	payment, err := store.getPaymentRequest(id)
+	if err != nil {
+		return
+	}
+	if payment.hash != nil {
+		return errors.New("payment already fulfilled")
+	}
+	if payment.state != "" {
+		return errors.New("payment already " + payment.state)
+	}
+	wa, err := store.getWalletAllocation(id)
+	if err != nil {
+		return
+	}
+	a, err := wallet.getAccount(ctx, wa.index, priorityRefund)
 	if err != nil {
 		return
 	}
-	a, err := wallet.getAccount(index)
+	// The watcher may have been stopped with a forward in flight which the
+	// node accepted; the merchant has been paid then, so complete instead.
+	hash, err := findForward(ctx, a.Address(), payment, wa.time)
 	if err != nil {
 		return
 	}
-	if err = refund(a); err != nil {
+	if hash != nil {
+		log.Printf("payment %s: found forward %s while closing, completing", id, hash)
+		if err = store.updatePaymentRequest(id, a.Address(), hash); err != nil {
+			return
+		}
+		if err = store.freeWalletIndex(id); err != nil {
+			return
+		}
+		if err = postCallback(map[string]string{
+			"id":         id,
+			"block_hash": hash.String(),
+			"status":     "completed",
+		}); err != nil {
+			log.Print(err)
+		}
+		return errors.New("payment already fulfilled")
+	}
+	refunds, err := refund(ctx, id, a)
+	if err != nil {
+		if len(refunds) > 0 {
+			if err := store.addPaymentRefunds(id, refunds); err != nil {
+				log.Print(err)
+			}
+		}
 		return
 	}
-	if err = deletePaymentRequest(id); err != nil {
+	if err = store.closePaymentRequest(id, state, reason, closedBy, refunds); err != nil {
 		return
 	}
-	return freeWalletIndex(id)
+	return store.freeWalletIndex(id)
 }
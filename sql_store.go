@@ -0,0 +1,904 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math/big"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hectorchu/gonano/rpc"
+	"github.com/hectorchu/gonano/util"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlStore implements storage on SQLite or PostgreSQL. Queries are written
+// with ? placeholders, rebound for PostgreSQL, and prepared once.
+//
+// Reads go through db and never open a write transaction. SQLite allows a
+// single writer, so on SQLite writes go through wdb, which begins
+// transactions with a write lock, and are serialized by wm rather than
+// contending for that lock; WAL lets reads proceed alongside them. wdb has a
+// second connection so that statements can be prepared while a transaction
+// holds the first. On PostgreSQL db and wdb are the same pool.
+type sqlStore struct {
+	db, wdb  *sql.DB
+	postgres bool
+	wm       sync.Mutex
+
+	m     sync.Mutex
+	stmts map[stmtKey]*sql.Stmt
+}
+
+type stmtKey struct {
+	db    *sql.DB
+	query string
+}
+
+// migrationLock is the PostgreSQL advisory lock held while migrating.
+const migrationLock = 0x6e616e6f
+
+// eventLock is the PostgreSQL advisory lock held from writing an event until
+// commit, so that events become visible in seq order and a reader polling
+// after a seq never misses one committed later with a lower seq. SQLite
+// writes are serialized already.
+const eventLock = 0x6e616e70
+
+func newSQLStore(driver, dsn string) (s *sqlStore, err error) {
+	s = &sqlStore{postgres: driver == "postgres", stmts: make(map[stmtKey]*sql.Stmt)}
+	if s.postgres {
+		if s.db, err = sql.Open(driver, dsn); err != nil {
+			return
+		}
+		s.db.SetMaxOpenConns(32)
+		s.db.SetMaxIdleConns(32)
+		s.wdb = s.db
+		return
+	}
+	if strings.Contains(dsn, "?") {
+		dsn += "&"
+	} else {
+		dsn += "?"
+	}
+	dsn += "_journal_mode=WAL&_busy_timeout=10000"
+	if s.db, err = sql.Open(driver, dsn); err != nil {
+		return
+	}
+	s.db.SetMaxOpenConns(runtime.NumCPU())
+	s.db.SetMaxIdleConns(runtime.NumCPU())
+	if s.wdb, err = sql.Open(driver, dsn+"&_txlock=immediate"); err != nil {
+		return
+	}
+	s.wdb.SetMaxOpenConns(2)
+	return
+}
+
+// q rebinds ? placeholders to $n for PostgreSQL.
+func (s *sqlStore) q(query string) string {
+	if !s.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func (s *sqlStore) prepare(db *sql.DB, query string) (stmt *sql.Stmt, err error) {
+	key := stmtKey{db, query}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if stmt = s.stmts[key]; stmt != nil {
+		return
+	}
+	if stmt, err = db.Prepare(s.q(query)); err != nil {
+		return
+	}
+	s.stmts[key] = stmt
+	return
+}
+
+// read prepares a query for the read pool.
+func (s *sqlStore) read(query string) (*sql.Stmt, error) {
+	return s.prepare(s.db, query)
+}
+
+// txStmt prepares a query for use in a write transaction.
+func (s *sqlStore) txStmt(tx *sql.Tx, query string) (stmt *sql.Stmt, err error) {
+	if stmt, err = s.prepare(s.wdb, query); err != nil {
+		return
+	}
+	return tx.Stmt(stmt), nil
+}
+
+func (s *sqlStore) txExec(tx *sql.Tx, query string, args ...interface{}) (err error) {
+	stmt, err := s.txStmt(tx, query)
+	if err != nil {
+		return
+	}
+	_, err = stmt.Exec(args...)
+	return
+}
+
+func (s *sqlStore) lockWrites() func() {
+	if s.postgres {
+		return func() {}
+	}
+	s.wm.Lock()
+	return s.wm.Unlock
+}
+
+func (s *sqlStore) withTx(f func(*sql.Tx) error) (err error) {
+	defer s.lockWrites()()
+	tx, err := s.wdb.Begin()
+	if err != nil {
+		return
+	}
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return
+	}
+	return tx.Commit()
+}
+
+// exec runs a single write statement outside of an explicit transaction.
+func (s *sqlStore) exec(query string, args ...interface{}) (err error) {
+	stmt, err := s.prepare(s.wdb, query)
+	if err != nil {
+		return
+	}
+	defer s.lockWrites()()
+	_, err = stmt.Exec(args...)
+	return
+}
+
+func (s *sqlStore) getConfig(key string) (value string, err error) {
+	stmt, err := s.read("SELECT value FROM config WHERE key = ?")
+	if err != nil {
+		return
+	}
+	err = stmt.QueryRow(key).Scan(&value)
+	return
+}
+
+func (s *sqlStore) setConfig(key, value string) (err error) {
+	return s.exec(`
+		INSERT INTO config(key, value) VALUES(?,?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, key, value)
+}
+
+func (s *sqlStore) newPaymentRequest(account string, amount *big.Int) (payment *paymentRecord, err error) {
+	id, err := newPaymentID()
+	if err != nil {
+		return
+	}
+	payment = &paymentRecord{id: id, account: account, amount: util.NanoAmount{Raw: amount}}
+	err = s.withTx(func(tx *sql.Tx) (err error) {
+		if err = s.txExec(tx, "INSERT INTO payments(id, account, amount, block_hash) VALUES(?,?,?,'')", id, account, amount.String()); err != nil {
+			return
+		}
+		return s.txEvent(tx, &paymentEvent{id: id, typ: "created", account: account, amount: amount})
+	})
+	return
+}
+
+// getPaymentRequest also finds archived payments, which have been closed.
+func (s *sqlStore) getPaymentRequest(id string) (payment *paymentRecord, err error) {
+	stmt, err := s.read(`
+		SELECT p.account, p.amount, p.block_hash, COALESCE(h.status, ''), COALESCE(NULLIF(p.reason, ''), h.reason, ''),
+			p.state, p.closed_by, p.refunds, COALESCE(p.closed_at, 0)
+		FROM payments p LEFT JOIN handoffs h ON h.id = p.id WHERE p.id = ?
+		UNION ALL
+		SELECT account, amount, block_hash, '', reason, state, closed_by, refunds, closed_at
+		FROM payments_archive WHERE id = ?
+	`)
+	if err != nil {
+		return
+	}
+	payment = &paymentRecord{id: id}
+	var (
+		amount, hash, refunds string
+		closedAt              int64
+	)
+	if err = stmt.QueryRow(id, id).Scan(
+		&payment.account, &amount, &hash, &payment.handoff, &payment.reason,
+		&payment.state, &payment.closedBy, &refunds, &closedAt,
+	); err != nil {
+		return nil, err
+	}
+	var ok bool
+	if payment.amount.Raw, ok = new(big.Int).SetString(amount, 10); !ok {
+		return nil, errors.New("could not decode amount")
+	}
+	if hash != "" {
+		if payment.hash, err = hex.DecodeString(hash); err != nil {
+			return nil, err
+		}
+	}
+	if refunds != "" {
+		for _, refund := range strings.Split(refunds, ",") {
+			hash, err := hex.DecodeString(refund)
+			if err != nil {
+				return nil, err
+			}
+			payment.refunds = append(payment.refunds, hash)
+		}
+	}
+	if closedAt != 0 {
+		payment.closedAt = time.Unix(closedAt, 0)
+	}
+	return
+}
+
+// updatePaymentRequest completes the payment with the block forwarding its
+// funds from the intermediate account.
+func (s *sqlStore) updatePaymentRequest(id, from string, hash rpc.BlockHash) (err error) {
+	return s.withTx(func(tx *sql.Tx) (err error) {
+		stmt, err := s.txStmt(tx, "SELECT account, amount FROM payments WHERE id = ?")
+		if err != nil {
+			return
+		}
+		e := &paymentEvent{id: id, typ: "forwarded", hash: hash}
+		var amount string
+		if err = stmt.QueryRow(id).Scan(&e.account, &amount); err != nil {
+			return
+		}
+		var ok bool
+		if e.amount, ok = new(big.Int).SetString(amount, 10); !ok {
+			return errors.New("could not decode amount")
+		}
+		if err = s.txExec(tx, "UPDATE payments SET block_hash = ? WHERE id = ?", hash.String(), id); err != nil {
+			return
+		}
+		if err = s.txEvent(tx, e); err != nil {
+			return
+		}
+		if err = s.txJournal(tx, &journalEntry{
+			id: id, kind: "forward", hash: hash, debit: e.account, credit: from, amount: e.amount,
+		}); err != nil {
+			return
+		}
+		s.txAuditJournal(tx, id)
+		return
+	})
+}
+
+func joinHashes(hashes []rpc.BlockHash) string {
+	s := make([]string, len(hashes))
+	for i, hash := range hashes {
+		s[i] = hash.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// appendRefunds adds to the refunds already recorded for a payment.
+const appendRefunds = "refunds = CASE refunds WHEN '' THEN ? ELSE refunds || ',' || ? END"
+
+// closePaymentRequest keeps the payment, recording why and by whom it was
+// closed and the blocks which refunded its funds.
+func (s *sqlStore) closePaymentRequest(id, state, reason, closedBy string, refunds []rpc.BlockHash) (err error) {
+	hashes := joinHashes(refunds)
+	return s.withTx(func(tx *sql.Tx) (err error) {
+		query := "UPDATE payments SET state = ?, reason = ?, closed_by = ?, closed_at = ? WHERE id = ?"
+		args := []interface{}{state, reason, closedBy, time.Now().Unix(), id}
+		if hashes != "" {
+			query = "UPDATE payments SET state = ?, reason = ?, closed_by = ?, closed_at = ?, " + appendRefunds + " WHERE id = ?"
+			args = []interface{}{state, reason, closedBy, time.Now().Unix(), hashes, hashes, id}
+		}
+		if err = s.txExec(tx, query, args...); err != nil {
+			return
+		}
+		if err = s.txEvent(tx, &paymentEvent{id: id, typ: state, reason: reason}); err != nil {
+			return
+		}
+		s.txAuditJournal(tx, id)
+		return
+	})
+}
+
+// addPaymentRefunds records refunds sent for a payment which is not yet
+// closed, such as those of a cancellation which failed part way.
+func (s *sqlStore) addPaymentRefunds(id string, refunds []rpc.BlockHash) (err error) {
+	hashes := joinHashes(refunds)
+	return s.exec("UPDATE payments SET "+appendRefunds+" WHERE id = ?", hashes, hashes, id)
+}
+
+// retirePaymentRequests archives, or purges, payments closed before the
+// given time. Their events are kept.
+func (s *sqlStore) retirePaymentRequests(before time.Time, purge bool) (n int64, err error) {
+	err = s.withTx(func(tx *sql.Tx) (err error) {
+		if !purge {
+			if err = s.txExec(tx, `
+				INSERT INTO payments_archive
+				SELECT id, account, amount, block_hash, state, reason, closed_by, refunds, closed_at
+				FROM payments WHERE state != '' AND closed_at < ?
+			`, before.Unix()); err != nil {
+				return
+			}
+		}
+		if err = s.txExec(tx, `
+			DELETE FROM handoffs WHERE id IN (SELECT id FROM payments WHERE state != '' AND closed_at < ?)
+		`, before.Unix()); err != nil {
+			return
+		}
+		stmt, err := s.txStmt(tx, "DELETE FROM payments WHERE state != '' AND closed_at < ?")
+		if err != nil {
+			return
+		}
+		result, err := stmt.Exec(before.Unix())
+		if err != nil {
+			return
+		}
+		n, err = result.RowsAffected()
+		return
+	})
+	return
+}
+
+func (s *sqlStore) updatePaymentHandoff(id string, hash rpc.BlockHash, block *rpc.Block) (err error) {
+	data, err := json.Marshal(block)
+	if err != nil {
+		return
+	}
+	return s.withTx(func(tx *sql.Tx) (err error) {
+		if err = s.txExec(tx, "UPDATE payments SET block_hash = ? WHERE id = ?", hash.String(), id); err != nil {
+			return
+		}
+		if err = s.txExec(tx, `
+			INSERT INTO handoffs(id, block, status, reason) VALUES(?,?,'pending','')
+			ON CONFLICT(id) DO UPDATE SET block = excluded.block, status = 'pending', reason = ''
+		`, id, string(data)); err != nil {
+			return
+		}
+		return s.txEvent(tx, &paymentEvent{id: id, typ: "handoff", hash: hash, account: block.Account})
+	})
+}
+
+func (s *sqlStore) confirmPaymentHandoff(id string) (err error) {
+	return s.withTx(func(tx *sql.Tx) (err error) {
+		if err = s.txExec(tx, "UPDATE handoffs SET status = 'confirmed' WHERE id = ?", id); err != nil {
+			return
+		}
+		return s.txEvent(tx, &paymentEvent{id: id, typ: "handoff_confirmed"})
+	})
+}
+
+func (s *sqlStore) failPaymentHandoff(id, reason string) (err error) {
+	return s.withTx(func(tx *sql.Tx) (err error) {
+		if err = s.txExec(tx, "UPDATE payments SET block_hash = '' WHERE id = ?", id); err != nil {
+			return
+		}
+		if err = s.txExec(tx, "UPDATE handoffs SET status = 'failed', reason = ? WHERE id = ?", reason, id); err != nil {
+			return
+		}
+		return s.txEvent(tx, &paymentEvent{id: id, typ: "handoff_failed", reason: reason})
+	})
+}
+
+func (s *sqlStore) getPendingHandoffs() (handoffs map[string]string, err error) {
+	handoffs = make(map[string]string)
+	stmt, err := s.read("SELECT id, block FROM handoffs WHERE status = 'pending'")
+	if err != nil {
+		return
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, block string
+		if err = rows.Scan(&id, &block); err != nil {
+			return
+		}
+		handoffs[id] = block
+	}
+	return handoffs, rows.Err()
+}
+
+func (s *sqlStore) revertPaymentHandoff(id string) (err error) {
+	return s.withTx(func(tx *sql.Tx) (err error) {
+		if err = s.txExec(tx, "UPDATE payments SET block_hash = '' WHERE id = ?", id); err != nil {
+			return
+		}
+		if err = s.txExec(tx, "DELETE FROM handoffs WHERE id = ?", id); err != nil {
+			return
+		}
+		return s.txEvent(tx, &paymentEvent{id: id, typ: "handoff_reverted"})
+	})
+}
+
+// getFreeWalletIndex allocates the lowest free index above min from the
+// wallet_free partial index, or a new index if none is free.
+func (s *sqlStore) getFreeWalletIndex(id string, min uint32) (index uint32, err error) {
+	now := time.Now().Unix()
+	err = s.withTx(func(tx *sql.Tx) (err error) {
+		query := "SELECT idx FROM wallet WHERE id = '' AND idx > ? ORDER BY idx LIMIT 1"
+		if s.postgres {
+			query += " FOR UPDATE SKIP LOCKED"
+		}
+		stmt, err := s.txStmt(tx, query)
+		if err != nil {
+			return
+		}
+		if stmt.QueryRow(min).Scan(&index) == nil {
+			return s.txExec(tx, "UPDATE wallet SET id = ?, time = ? WHERE idx = ?", id, now, index)
+		}
+		if s.postgres {
+			if stmt, err = s.txStmt(tx, "INSERT INTO wallet(id, time) VALUES(?,?) RETURNING idx"); err != nil {
+				return
+			}
+			return stmt.QueryRow(id, now).Scan(&index)
+		}
+		if stmt, err = s.txStmt(tx, "INSERT INTO wallet(id, time) VALUES(?,?)"); err != nil {
+			return
+		}
+		result, err := stmt.Exec(id, now)
+		if err != nil {
+			return
+		}
+		rowid, err := result.LastInsertId()
+		if err != nil {
+			return
+		}
+		index = uint32(rowid)
+		return
+	})
+	return
+}
+
+func (s *sqlStore) getWalletIndex(id string) (index uint32, err error) {
+	stmt, err := s.read("SELECT idx FROM wallet WHERE id = ?")
+	if err != nil {
+		return
+	}
+	err = stmt.QueryRow(id).Scan(&index)
+	return
+}
+
+func (s *sqlStore) getWalletAllocation(id string) (wa walletAllocation, err error) {
+	stmt, err := s.read("SELECT id, idx, time FROM wallet WHERE id = ?")
+	if err != nil {
+		return
+	}
+	var t int64
+	err = stmt.QueryRow(id).Scan(&wa.id, &wa.index, &t)
+	wa.time = time.Unix(t, 0)
+	return
+}
+
+func (s *sqlStore) getWalletAllocations() (allocations []walletAllocation, err error) {
+	stmt, err := s.read("SELECT id, idx, time FROM wallet WHERE id != ''")
+	if err != nil {
+		return
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			wa walletAllocation
+			t  int64
+		)
+		if err = rows.Scan(&wa.id, &wa.index, &t); err != nil {
+			return
+		}
+		wa.time = time.Unix(t, 0)
+		allocations = append(allocations, wa)
+	}
+	return allocations, rows.Err()
+}
+
+func (s *sqlStore) getWalletIndexesOlderThan(t time.Time) (ids []string, err error) {
+	stmt, err := s.read("SELECT id FROM wallet WHERE time < ?")
+	if err != nil {
+		return
+	}
+	rows, err := stmt.Query(t.Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		id := ""
+		if err = rows.Scan(&id); err != nil {
+			return
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *sqlStore) freeWalletIndex(id string) (err error) {
+	return s.exec("UPDATE wallet SET id = '', time = NULL WHERE id = ?", id)
+}
+
+func (s *sqlStore) getCachedWork(root rpc.BlockHash) (work rpc.HexData, err error) {
+	stmt, err := s.read("SELECT work FROM work_cache WHERE root = ?")
+	if err != nil {
+		return
+	}
+	var w string
+	if err = stmt.QueryRow(root.String()).Scan(&w); err != nil {
+		return
+	}
+	return hex.DecodeString(w)
+}
+
+func (s *sqlStore) setCachedWork(root rpc.BlockHash, work rpc.HexData) (err error) {
+	return s.exec(`
+		INSERT INTO work_cache(root, work, time) VALUES(?,?,?)
+		ON CONFLICT(root) DO UPDATE SET work = excluded.work, time = excluded.time
+	`, root.String(), hex.EncodeToString(work), time.Now().Unix())
+}
+
+func (s *sqlStore) deleteCachedWork(root rpc.BlockHash) (err error) {
+	return s.exec("DELETE FROM work_cache WHERE root = ?", root.String())
+}
+
+func (s *sqlStore) deleteCachedWorkOlderThan(t time.Time) (err error) {
+	return s.exec("DELETE FROM work_cache WHERE time < ?", t.Unix())
+}
+
+// addCallback records a callback before its first delivery attempt.
+func (s *sqlStore) addCallback(id string, body []byte) (seq int64, err error) {
+	now := time.Now().Unix()
+	err = s.withTx(func(tx *sql.Tx) (err error) {
+		if s.postgres {
+			stmt, err := s.txStmt(tx, "INSERT INTO callbacks(id, body, attempts, time) VALUES(?,?,0,?) RETURNING seq")
+			if err != nil {
+				return err
+			}
+			return stmt.QueryRow(id, string(body), now).Scan(&seq)
+		}
+		stmt, err := s.txStmt(tx, "INSERT INTO callbacks(id, body, attempts, time) VALUES(?,?,0,?)")
+		if err != nil {
+			return
+		}
+		result, err := stmt.Exec(id, string(body), now)
+		if err != nil {
+			return
+		}
+		seq, err = result.LastInsertId()
+		return
+	})
+	return
+}
+
+func (s *sqlStore) getCallbacks() (callbacks []pendingCallback, err error) {
+	stmt, err := s.read("SELECT seq, id, body, attempts, time FROM callbacks ORDER BY seq")
+	if err != nil {
+		return
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			c    pendingCallback
+			body string
+			t    int64
+		)
+		if err = rows.Scan(&c.seq, &c.id, &body, &c.attempts, &t); err != nil {
+			return
+		}
+		c.body, c.time = []byte(body), time.Unix(t, 0)
+		callbacks = append(callbacks, c)
+	}
+	return callbacks, rows.Err()
+}
+
+// retryCallback records a failed delivery attempt.
+func (s *sqlStore) retryCallback(seq int64) (err error) {
+	return s.exec("UPDATE callbacks SET attempts = attempts + 1, time = ? WHERE seq = ?", time.Now().Unix(), seq)
+}
+
+func (s *sqlStore) deleteCallback(seq int64) (err error) {
+	return s.exec("DELETE FROM callbacks WHERE seq = ?", seq)
+}
+
+// txEvent appends an event in the transaction making the change it records.
+func (s *sqlStore) txEvent(tx *sql.Tx, e *paymentEvent) (err error) {
+	if s.postgres {
+		if err = s.txExec(tx, "SELECT pg_advisory_xact_lock(?)", eventLock); err != nil {
+			return
+		}
+	}
+	amount := ""
+	if e.amount != nil {
+		amount = e.amount.String()
+	}
+	hash := ""
+	if e.hash != nil {
+		hash = e.hash.String()
+	}
+	return s.txExec(tx, `
+		INSERT INTO events(id, type, time, block_hash, account, amount, reason) VALUES(?,?,?,?,?,?,?)
+	`, e.id, e.typ, time.Now().Unix(), hash, e.account, amount, e.reason)
+}
+
+// addEvent records an event and, if the event moved funds, its journal entry.
+func (s *sqlStore) addEvent(e *paymentEvent, j *journalEntry) (err error) {
+	return s.withTx(func(tx *sql.Tx) (err error) {
+		if err = s.txEvent(tx, e); err != nil || j == nil {
+			return
+		}
+		return s.txJournal(tx, j)
+	})
+}
+
+func (s *sqlStore) getEvents(after int64, limit int) (events []paymentEvent, err error) {
+	stmt, err := s.read(`
+		SELECT seq, id, type, time, block_hash, account, amount, reason
+		FROM events WHERE seq > ? ORDER BY seq LIMIT ?
+	`)
+	if err != nil {
+		return
+	}
+	rows, err := stmt.Query(after, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			e            paymentEvent
+			t            int64
+			hash, amount string
+		)
+		if err = rows.Scan(&e.seq, &e.id, &e.typ, &t, &hash, &e.account, &amount, &e.reason); err != nil {
+			return
+		}
+		e.time = time.Unix(t, 0)
+		if hash != "" {
+			if e.hash, err = hex.DecodeString(hash); err != nil {
+				return
+			}
+		}
+		if amount != "" {
+			var ok bool
+			if e.amount, ok = new(big.Int).SetString(amount, 10); !ok {
+				return nil, errors.New("could not decode amount")
+			}
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *sqlStore) txJournal(tx *sql.Tx, j *journalEntry) (err error) {
+	return s.txExec(tx, `
+		INSERT INTO journal(id, kind, block_hash, debit, credit, amount, time) VALUES(?,?,?,?,?,?,?)
+	`, j.id, j.kind, j.hash.String(), j.debit, j.credit, j.amount.String(), time.Now().Unix())
+}
+
+// journalVersion is the migration which added the journal.
+const journalVersion = 6
+
+var journalImbalances = expvar.NewInt("journal_imbalances")
+
+type journalImbalance struct {
+	id, account string
+	net         *big.Int
+}
+
+func (e *journalImbalance) Error() string {
+	return fmt.Sprintf("journal for payment %s does not balance: %s nets to %s raw", e.id, e.account, e.net)
+}
+
+// txAuditJournal checks that each intermediate account of a payment being
+// settled, debited by its receives and credited by its forward and refunds,
+// nets to zero. The payment's blocks are already on the ledger, so the update
+// goes ahead regardless; an imbalance, such as an entry lost to a crash
+// between publishing a block and journaling it, is raised as an ALERT to be
+// reconciled against the ledger.
+func (s *sqlStore) txAuditJournal(tx *sql.Tx, id string) {
+	err := s.txCheckJournal(tx, id)
+	if _, ok := err.(*journalImbalance); ok {
+		journalImbalances.Add(1)
+		log.Printf("ALERT: %s", err)
+	} else if err != nil {
+		log.Printf("auditing journal for payment %s: %s", id, err)
+	}
+}
+
+// txCheckJournal returns a *journalImbalance unless the payment's journal
+// nets to zero. Payments created before the journal was added, whose
+// receives were never journaled, are not checked.
+func (s *sqlStore) txCheckJournal(tx *sql.Tx, id string) (err error) {
+	stmt, err := s.txStmt(tx, `
+		SELECT COUNT(*) FROM events, schema_version
+		WHERE events.id = ? AND events.type = 'created' AND schema_version.version = ? AND events.time >= schema_version.applied
+	`)
+	if err != nil {
+		return
+	}
+	var journaled int
+	if err = stmt.QueryRow(id, journalVersion).Scan(&journaled); err != nil || journaled == 0 {
+		return
+	}
+	if stmt, err = s.txStmt(tx, "SELECT kind, debit, credit, amount FROM journal WHERE id = ?"); err != nil {
+		return
+	}
+	rows, err := stmt.Query(id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	var intermediate []string
+	net := make(map[string]*big.Int)
+	for rows.Next() {
+		var kind, debit, credit, amount string
+		if err = rows.Scan(&kind, &debit, &credit, &amount); err != nil {
+			return
+		}
+		x, ok := new(big.Int).SetString(amount, 10)
+		if !ok {
+			return errors.New("could not decode amount")
+		}
+		account := credit
+		if kind == "receive" {
+			account = debit
+		} else {
+			x.Neg(x)
+		}
+		if net[account] == nil {
+			net[account] = new(big.Int)
+			intermediate = append(intermediate, account)
+		}
+		net[account].Add(net[account], x)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for _, account := range intermediate {
+		if net[account].Sign() != 0 {
+			return &journalImbalance{id, account, net[account]}
+		}
+	}
+	return
+}
+
+func (s *sqlStore) getJournal(id string) (entries []journalEntry, err error) {
+	stmt, err := s.read(`
+		SELECT seq, id, kind, block_hash, debit, credit, amount, time
+		FROM journal WHERE id = ? ORDER BY seq
+	`)
+	if err != nil {
+		return
+	}
+	rows, err := stmt.Query(id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			j            journalEntry
+			t            int64
+			hash, amount string
+		)
+		if err = rows.Scan(&j.seq, &j.id, &j.kind, &hash, &j.debit, &j.credit, &amount, &t); err != nil {
+			return
+		}
+		j.time = time.Unix(t, 0)
+		if j.hash, err = hex.DecodeString(hash); err != nil {
+			return
+		}
+		var ok bool
+		if j.amount, ok = new(big.Int).SetString(amount, 10); !ok {
+			return nil, errors.New("could not decode amount")
+		}
+		entries = append(entries, j)
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqlStore) appliedMigrations() (applied map[int]time.Time, err error) {
+	applied = make(map[int]time.Time)
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'"
+	if s.postgres {
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_version'"
+	}
+	var n int
+	if err = s.db.QueryRow(query).Scan(&n); err != nil || n == 0 {
+		return
+	}
+	rows, err := s.db.Query("SELECT version, applied FROM schema_version")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var t int64
+		if err = rows.Scan(&version, &t); err != nil {
+			return
+		}
+		applied[version] = time.Unix(t, 0)
+	}
+	return applied, rows.Err()
+}
+
+// migrate applies pending migrations in a single transaction, holding a
+// lock which keeps other servers sharing the database from migrating
+// concurrently: a write lock from BEGIN IMMEDIATE on SQLite, and an
+// advisory lock on PostgreSQL.
+func (s *sqlStore) migrate() (applied []int, err error) {
+	ctx := context.Background()
+	conn, err := s.wdb.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	begin := "BEGIN IMMEDIATE"
+	if s.postgres {
+		begin = "BEGIN"
+	}
+	if _, err = conn.ExecContext(ctx, begin); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			conn.ExecContext(ctx, "ROLLBACK")
+			applied = nil
+		}
+	}()
+	if s.postgres {
+		if _, err = conn.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLock); err != nil {
+			return
+		}
+	}
+	if _, err = conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_version(version INTEGER PRIMARY KEY, applied BIGINT NOT NULL)"); err != nil {
+		return
+	}
+	var current int
+	if err = conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current); err != nil {
+		return
+	}
+	if current > len(migrations) {
+		return nil, fmt.Errorf("database schema version %d is newer than this server supports", current)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		stmts := m.sqlite
+		if s.postgres {
+			stmts = m.postgres
+		}
+		for _, stmt := range stmts {
+			if _, err = conn.ExecContext(ctx, stmt); err != nil {
+				return nil, fmt.Errorf("migration %d: %v", m.version, err)
+			}
+		}
+		if _, err = conn.ExecContext(ctx, s.q("INSERT INTO schema_version(version, applied) VALUES(?,?)"), m.version, time.Now().Unix()); err != nil {
+			return
+		}
+		applied = append(applied, m.version)
+	}
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	return
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hectorchu/gonano/rpc"
+)
+
+const benchAccount = "nano_1111111111111111111111111111111111111111111111111111hifc8npp"
+
+// benchStores runs f against a fresh SQLite store, and against the
+// PostgreSQL database in PAYMENT_TEST_POSTGRES if it is set.
+func benchStores(b *testing.B, f func(b *testing.B, s *sqlStore)) {
+	run := func(b *testing.B, driver, dsn string) {
+		s, err := newSQLStore(driver, dsn)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer s.db.Close()
+		if s.wdb != s.db {
+			defer s.wdb.Close()
+		}
+		if _, err = s.migrate(); err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		f(b, s)
+	}
+	b.Run("sqlite", func(b *testing.B) {
+		run(b, "sqlite3", filepath.Join(b.TempDir(), "bench.db"))
+	})
+	b.Run("postgres", func(b *testing.B) {
+		dsn := os.Getenv("PAYMENT_TEST_POSTGRES")
+		if dsn == "" {
+			b.Skip("PAYMENT_TEST_POSTGRES is not set")
+		}
+		run(b, "postgres", dsn)
+	})
+}
+
+func benchNewPayment(s *sqlStore) (id string, err error) {
+	payment, err := s.newPaymentRequest(benchAccount, big.NewInt(1))
+	if err != nil {
+		return
+	}
+	_, err = s.getFreeWalletIndex(payment.id, 0)
+	return payment.id, err
+}
+
+// BenchmarkStoreNewPayment measures the storage work of /payment/new.
+func BenchmarkStoreNewPayment(b *testing.B) {
+	benchStores(b, func(b *testing.B, s *sqlStore) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := benchNewPayment(s); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkStoreGetPayment measures payment lookups, as made by
+// /payment/status and the watchers.
+func BenchmarkStoreGetPayment(b *testing.B) {
+	benchStores(b, func(b *testing.B, s *sqlStore) {
+		b.StopTimer()
+		ids := make([]string, 1000)
+		for i := range ids {
+			var err error
+			if ids[i], err = benchNewPayment(s); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := s.getPaymentRequest(ids[rand.Intn(len(ids))]); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkStorePaymentLifecycle creates payments and cancels them, which
+// frees their intermediate account indexes for reuse.
+func BenchmarkStorePaymentLifecycle(b *testing.B) {
+	benchStores(b, func(b *testing.B, s *sqlStore) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				id, err := benchNewPayment(s)
+				if err == nil {
+					_, err = s.getPaymentRequest(id)
+				}
+				if err == nil {
+					err = s.closePaymentRequest(id, "cancelled", "benchmark", "api", nil)
+				}
+				if err == nil {
+					err = s.freeWalletIndex(id)
+				}
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// newTestStore opens a fresh, migrated SQLite store for the test.
+func newTestStore(t *testing.T) *sqlStore {
+	t.Helper()
+	s, err := newSQLStore("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.db.Close()
+		s.wdb.Close()
+	})
+	if _, err = s.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRefundsKeptAcrossAttempts(t *testing.T) {
+	s := newTestStore(t)
+	payment, err := s.newPaymentRequest(benchAccount, big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	if err = s.addPaymentRefunds(payment.id, []rpc.BlockHash{first}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.closePaymentRequest(payment.id, "cancelled", "", "api", []rpc.BlockHash{second}); err != nil {
+		t.Fatal(err)
+	}
+	if payment, err = s.getPaymentRequest(payment.id); err != nil {
+		t.Fatal(err)
+	}
+	if len(payment.refunds) != 2 || !bytes.Equal(payment.refunds[0], first) || !bytes.Equal(payment.refunds[1], second) {
+		t.Fatalf("refunds %v, want the first attempt's followed by the second's", payment.refunds)
+	}
+}
+
+func TestJournalImbalanceDoesNotBlockSettling(t *testing.T) {
+	s := newTestStore(t)
+	const intermediate = "nano_3i1aq1cchnmbn9x5rsbap8b15akfh7wj7pwskuzi7ahz8oq6cobd99d4r3b7"
+	settle := func(received, forwarded int64) *paymentRecord {
+		payment, err := s.newPaymentRequest(benchAccount, big.NewInt(forwarded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive := make(rpc.BlockHash, 32)
+		rand.Read(receive)
+		if err = s.addEvent(
+			&paymentEvent{id: payment.id, typ: "received", hash: receive, amount: big.NewInt(received)},
+			&journalEntry{id: payment.id, kind: "receive", hash: receive, debit: intermediate, credit: benchAccount, amount: big.NewInt(received)},
+		); err != nil {
+			t.Fatal(err)
+		}
+		forward := make(rpc.BlockHash, 32)
+		rand.Read(forward)
+		if err = s.updatePaymentRequest(payment.id, intermediate, forward); err != nil {
+			t.Fatal(err)
+		}
+		if payment, err = s.getPaymentRequest(payment.id); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payment.hash, forward) {
+			t.Fatalf("payment %s not completed", payment.id)
+		}
+		return payment
+	}
+	alerts := journalImbalances.Value()
+	settle(5, 5)
+	if journalImbalances.Value() != alerts {
+		t.Fatal("balanced journal raised an alert")
+	}
+	settle(5, 3)
+	if journalImbalances.Value() != alerts+1 {
+		t.Fatal("unbalanced journal did not raise an alert")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s := newTestStore(t)
+	payment, err := s.newPaymentRequest(benchAccount, big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"created"}
+	for _, typ := range []string{"received", "refunded", "received", "forwarded"} {
+		hash := make(rpc.BlockHash, 32)
+		rand.Read(hash)
+		if err = s.addEvent(&paymentEvent{id: payment.id, typ: typ, hash: hash, amount: big.NewInt(1)}, nil); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, typ)
+	}
+
+	events, err := s.getEvents(0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(want) {
+		t.Fatalf("%d events, want %d", len(events), len(want))
+	}
+	for i, e := range events {
+		if e.typ != want[i] || e.id != payment.id {
+			t.Fatalf("event %d is %s of %s, want %s of %s", i, e.typ, e.id, want[i], payment.id)
+		}
+		if i > 0 && e.seq <= events[i-1].seq {
+			t.Fatalf("event %d has seq %d after %d", i, e.seq, events[i-1].seq)
+		}
+	}
+
+	for _, limit := range []int{1, 3, len(want), len(want) + 1} {
+		got, err := s.getEvents(0, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := limit
+		if n > len(want) {
+			n = len(want)
+		}
+		if len(got) != n || got[0].seq != events[0].seq || got[n-1].seq != events[n-1].seq {
+			t.Fatalf("limit %d returned %d events", limit, len(got))
+		}
+	}
+
+	for i, e := range events {
+		got, err := s.getEvents(e.seq, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(events)-i-1 || len(got) > 0 && got[0].seq != events[i+1].seq {
+			t.Fatalf("%d events after seq %d, want %d from %d", len(got), e.seq, len(events)-i-1, e.seq)
+		}
+	}
+	if got, err := s.getEvents(events[1].seq, 2); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 2 || got[0].seq != events[2].seq || got[1].seq != events[3].seq {
+		t.Fatalf("limit after a cursor returned %v", got)
+	}
+}
@@ -1,110 +1,150 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
-	"database/sql"
+	"encoding/binary"
 	"encoding/hex"
-	"sync"
-	"time"
+	"errors"
+	"math/big"
 
-	"github.com/hectorchu/gonano/wallet"
+	"github.com/hectorchu/gonano/rpc"
+	"github.com/hectorchu/gonano/util"
+	"github.com/hectorchu/gonano/wallet/ed25519"
+	"golang.org/x/crypto/blake2b"
 )
 
+// defaultRepresentative is the representative of newly opened accounts,
+// as chosen by the gonano wallet which opened them before.
+const defaultRepresentative = "nano_3gonano8jnse4zm65jaiki9tk8ry4jtgc1smarinukho6fmbc45k3icsh6en"
+
 // Wallet is a simple wallet.
 type Wallet struct {
 	seed []byte
-	m    sync.Mutex
-	w    *wallet.Wallet
 }
 
 func newWallet(seed []byte) (w *Wallet, err error) {
-	w = &Wallet{seed: seed}
-	if w.w, err = wallet.NewWallet(seed); err != nil {
+	return &Wallet{seed: seed}, nil
+}
+
+// Account is an intermediate account. Its blocks are built and signed here
+// and given work by the work cache and engine at the account's priority,
+// so that failing to generate work is reported to the caller.
+type Account struct {
+	ctx      context.Context
+	priority int
+	index    uint32
+	address  string
+	key      ed25519.PrivateKey
+}
+
+func (w *Wallet) getAccount(ctx context.Context, index uint32, priority int) (a *Account, err error) {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return
+	}
+	h.Write(w.seed)
+	binary.Write(h, binary.BigEndian, index)
+	pubkey, key, err := ed25519.GenerateKey(bytes.NewReader(h.Sum(nil)))
+	if err != nil {
 		return
 	}
-	w.w.RPC.URL = *rpcURL
-	w.w.RPCWork.URL = *powURL
+	a = &Account{ctx: ctx, priority: priority, index: index, key: key}
+	if a.address, err = util.PubkeyToAddress(pubkey); err != nil {
+		return nil, err
+	}
 	return
 }
 
-func (w *Wallet) getAccount(index uint32) (a *wallet.Account, err error) {
-	w.m.Lock()
-	defer w.m.Unlock()
-	return w.w.NewAccount(&index)
+func (a *Account) Address() string {
+	return a.address
 }
 
-func loadWallet() (w *Wallet, err error) {
-	if seed, err := getConfig("wallet_seed"); err == nil {
-		seed, err := hex.DecodeString(seed)
-		if err != nil {
-			return nil, err
-		}
-		return newWallet(seed)
+func (a *Account) Balance() (balance, pending *big.Int, err error) {
+	b, p, err := stickyClient(a.ctx, a.address).AccountBalance(a.address)
+	if err != nil {
+		return
 	}
-	seed := make([]byte, 32)
-	if _, err = rand.Read(seed); err != nil {
+	return &b.Int, &p.Int, nil
+}
+
+// Send sends amount to account.
+func (a *Account) Send(account string, amount *big.Int) (hash rpc.BlockHash, err error) {
+	link, err := util.AddressToPubkey(account)
+	if err != nil {
 		return
 	}
-	if w, err = newWallet(seed); err != nil {
+	client := stickyClient(a.ctx, a.address)
+	info, err := client.AccountInfo(a.address)
+	if err != nil {
 		return
 	}
-	err = setConfig("wallet_seed", hex.EncodeToString(seed))
-	return
+	balance := new(big.Int).Sub(&info.Balance.Int, amount)
+	if balance.Sign() < 0 {
+		return nil, errors.New("insufficient funds")
+	}
+	return a.process(client, &rpc.Block{
+		Type:           "state",
+		Account:        a.address,
+		Previous:       info.Frontier,
+		Representative: info.Representative,
+		Balance:        &rpc.RawAmount{Int: *balance},
+		Link:           link,
+	}, info.Frontier, sendDifficulty, "send")
 }
 
-func getFreeWalletIndex(id string, min uint32) (index uint32, err error) {
-	now := time.Now().Unix()
-	err = withDB(func(tx *sql.Tx) (err error) {
-		if tx.QueryRow(`SELECT rowid FROM wallet WHERE id = "" AND rowid > ? LIMIT 1`, min).Scan(&index) == nil {
-			_, err = tx.Exec("UPDATE wallet SET id = ?, time = ? WHERE rowid = ?", id, now, index)
-			return
-		}
-		if _, err = tx.Exec("CREATE TABLE IF NOT EXISTS wallet(id TEXT, time INTEGER)"); err != nil {
-			return
-		}
-		result, err := tx.Exec("INSERT INTO wallet VALUES(?,?)", id, now)
-		if err != nil {
-			return
-		}
-		rowid, err := result.LastInsertId()
-		if err != nil {
-			return
-		}
-		index = uint32(rowid)
+// ReceivePending receives the send block link, opening the account if
+// need be.
+func (a *Account) ReceivePending(link rpc.BlockHash) (hash rpc.BlockHash, err error) {
+	client := stickyClient(a.ctx, a.address)
+	send, err := client.BlockInfo(link)
+	if err != nil {
 		return
-	})
-	return
+	}
+	block := &rpc.Block{Type: "state", Account: a.address, Link: link}
+	root := rpc.BlockHash(a.key[32:])
+	balance := new(big.Int)
+	if info, err := client.AccountInfo(a.address); err == nil {
+		block.Previous, block.Representative, root = info.Frontier, info.Representative, info.Frontier
+		balance.Set(&info.Balance.Int)
+	} else if err.Error() == "Account not found" {
+		block.Previous, block.Representative = make(rpc.BlockHash, 32), defaultRepresentative
+	} else {
+		return nil, err
+	}
+	block.Balance = &rpc.RawAmount{Int: *balance.Add(balance, &send.Amount.Int)}
+	return a.process(client, block, root, receiveDifficulty, "receive")
 }
 
-func getWalletIndex(id string) (index uint32, err error) {
-	err = withDB(func(tx *sql.Tx) error {
-		return tx.QueryRow("SELECT rowid FROM wallet WHERE id = ?", id).Scan(&index)
-	})
-	return
+func (a *Account) process(
+	client *rpc.Client, block *rpc.Block, root rpc.BlockHash, difficulty []byte, subtype string,
+) (hash rpc.BlockHash, err error) {
+	if hash, err = block.Hash(); err != nil {
+		return
+	}
+	block.Signature = ed25519.Sign(a.key, hash)
+	if block.Work, err = works.generate(a.ctx, root, difficulty, a.priority); err != nil {
+		return
+	}
+	return client.Process(block, subtype)
 }
 
-func getWalletIndexesOlderThan(t time.Time) (ids []string, err error) {
-	err = withDB(func(tx *sql.Tx) (err error) {
-		rows, err := tx.Query("SELECT id FROM wallet WHERE time < ?", t.Unix())
+func loadWallet() (w *Wallet, err error) {
+	if seed, err := store.getConfig("wallet_seed"); err == nil {
+		seed, err := hex.DecodeString(seed)
 		if err != nil {
-			return
-		}
-		defer rows.Close()
-		for rows.Next() {
-			id := ""
-			if err = rows.Scan(&id); err != nil {
-				return
-			}
-			ids = append(ids, id)
+			return nil, err
 		}
-		return rows.Err()
-	})
-	return
-}
-
-func freeWalletIndex(id string) (err error) {
-	return withDB(func(tx *sql.Tx) (err error) {
-		_, err = tx.Exec(`UPDATE wallet SET id = "", time = NULL WHERE id = ?`, id)
+		return newWallet(seed)
+	}
+	seed := make([]byte, 32)
+	if _, err = rand.Read(seed); err != nil {
+		return
+	}
+	if w, err = newWallet(seed); err != nil {
 		return
-	})
+	}
+	err = store.setConfig("wallet_seed", hex.EncodeToString(seed))
+	return
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type paymentWatch struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type watcherMap struct {
+	m    sync.Mutex
+	w    map[string]*paymentWatch
+	held map[string]bool
+}
+
+var watchers = &watcherMap{w: make(map[string]*paymentWatch), held: make(map[string]bool)}
+
+func (m *watcherMap) start(wallet *Wallet, det detector, id string) <-chan struct{} {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if pw, ok := m.w[id]; ok {
+		return pw.done
+	}
+	if m.held[id] {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pw := &paymentWatch{cancel: cancel, done: make(chan struct{})}
+	m.w[id] = pw
+	go func() {
+		watchPayment(ctx, wallet, det, id)
+		m.m.Lock()
+		delete(m.w, id)
+		m.m.Unlock()
+		cancel()
+		close(pw.done)
+	}()
+	return pw.done
+}
+
+// hold stops the payment's watcher and keeps it from being started again
+// until release, while the payment is cancelled or handed off.
+func (m *watcherMap) hold(id string) {
+	m.m.Lock()
+	m.held[id] = true
+	pw, ok := m.w[id]
+	m.m.Unlock()
+	if ok {
+		pw.cancel()
+		<-pw.done
+	}
+}
+
+func (m *watcherMap) release(id string) {
+	m.m.Lock()
+	delete(m.held, id)
+	m.m.Unlock()
+}
+
+func watchPayment(ctx context.Context, wallet *Wallet, det detector, id string) {
+	for {
+		err := completePayment(ctx, wallet, det, id)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		log.Print(err)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func completePayment(ctx context.Context, wallet *Wallet, det detector, id string) (err error) {
+	payment, err := store.getPaymentRequest(id)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil || payment.hash != nil || payment.state != "" {
+		return
+	}
+	wa, err := store.getWalletAllocation(id)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return
+	}
+	a, err := wallet.getAccount(ctx, wa.index, priorityForward)
+	if err != nil {
+		return
+	}
+	hash, err := findForward(ctx, a.Address(), payment, wa.time)
+	if err != nil {
+		return
+	}
+	if hash == nil {
+		if hash, err = waitReceive(ctx, det, id, a, payment.account, payment.amount.Raw); err != nil {
+			return
+		}
+	}
+	if err = store.updatePaymentRequest(id, a.Address(), hash); err != nil {
+		log.Print(err)
+		return nil
+	}
+	if err = store.freeWalletIndex(id); err != nil {
+		log.Print(err)
+	}
+	if err = postCallback(map[string]string{
+		"id":         id,
+		"block_hash": hash.String(),
+		"status":     "completed",
+	}); err != nil {
+		log.Print(err)
+	}
+	return nil
+}
+
+// checkWatch fails once payment id is closed or no longer holds the wallet
+// index of a, so that a watcher which outlived it stops before moving funds
+// which may now belong to another payment.
+func checkWatch(id string, a *Account) (err error) {
+	payment, err := store.getPaymentRequest(id)
+	if err != nil {
+		return
+	}
+	if payment.state != "" {
+		return fmt.Errorf("payment %s: %s, stopped watching %s", id, payment.state, a.Address())
+	}
+	if index, err := store.getWalletIndex(id); err == sql.ErrNoRows || err == nil && index != a.index {
+		return fmt.Errorf("payment %s: no longer holds %s, stopped watching", id, a.Address())
+	} else if err != nil {
+		return err
+	}
+	return
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hectorchu/gonano/rpc"
+	"github.com/hectorchu/gonano/util"
+)
+
+var (
+	sendDifficulty, _    = hex.DecodeString("fffffff800000000")
+	receiveDifficulty, _ = hex.DecodeString("fffffe0000000000")
+	workPeers            []*workPeer
+	works                = &workCache{jobs: make(map[string]bool)}
+	activeDifficulty     struct {
+		m             sync.Mutex
+		multiplier    float64
+		send, receive []byte
+		updated       time.Time
+	}
+)
+
+func networkMultiplier() float64 {
+	activeDifficulty.m.Lock()
+	defer activeDifficulty.m.Unlock()
+	if time.Since(activeDifficulty.updated) < 10*time.Second {
+		return activeDifficulty.multiplier
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := nodeClient(ctx)
+	var v struct {
+		Multiplier            float64     `json:",string"`
+		NetworkMinimum        rpc.HexData `json:"network_minimum"`
+		NetworkReceiveMinimum rpc.HexData `json:"network_receive_minimum"`
+	}
+	if err := rpcCall(client, map[string]interface{}{"action": "active_difficulty"}, &v); err != nil {
+		log.Print(err)
+		v.Multiplier = activeDifficulty.multiplier
+	}
+	if v.Multiplier < 1 {
+		v.Multiplier = 1
+	}
+	if len(v.NetworkMinimum) == 8 {
+		activeDifficulty.send = v.NetworkMinimum
+	}
+	if len(v.NetworkReceiveMinimum) == 8 {
+		activeDifficulty.receive = v.NetworkReceiveMinimum
+	}
+	activeDifficulty.multiplier, activeDifficulty.updated = v.Multiplier, time.Now()
+	return v.Multiplier
+}
+
+func networkMinimum(base []byte) []byte {
+	networkMultiplier()
+	activeDifficulty.m.Lock()
+	defer activeDifficulty.m.Unlock()
+	switch {
+	case bytes.Equal(base, sendDifficulty) && activeDifficulty.send != nil:
+		return activeDifficulty.send
+	case bytes.Equal(base, receiveDifficulty) && activeDifficulty.receive != nil:
+		return activeDifficulty.receive
+	}
+	return base
+}
+
+func scaleDifficulty(base []byte, multiplier float64) (difficulty []byte) {
+	if multiplier > *powMaxMultiplier {
+		multiplier = *powMaxMultiplier
+	}
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	d := -binary.BigEndian.Uint64(base)
+	d = uint64(float64(d) / multiplier)
+	difficulty = make([]byte, 8)
+	binary.BigEndian.PutUint64(difficulty, -d)
+	return
+}
+
+func currentDifficulty(base []byte) []byte {
+	return scaleDifficulty(networkMinimum(base), networkMultiplier())
+}
+
+type workCache struct {
+	m    sync.Mutex
+	jobs map[string]bool
+}
+
+func (c *workCache) generate(
+	ctx context.Context, root rpc.BlockHash, difficulty []byte, priority int,
+) (work rpc.HexData, err error) {
+	difficulty = currentDifficulty(difficulty)
+	if work, err = store.getCachedWork(root); err != nil || !validateWork(root, work, difficulty) {
+		if work, err = generateWork(ctx, root, difficulty, priority); err != nil {
+			return
+		}
+	}
+	// The work is good regardless; an entry left behind is only stale, and
+	// is found invalid or expired later.
+	if err := store.deleteCachedWork(root); err != nil {
+		log.Print(err)
+	}
+	return work, nil
+}
+
+func (c *workCache) precompute(root rpc.BlockHash, difficulty []byte) {
+	difficulty = currentDifficulty(difficulty)
+	if work, err := store.getCachedWork(root); err == nil && validateWork(root, work, difficulty) {
+		return
+	}
+	key := root.String()
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.jobs[key] {
+		return
+	}
+	c.jobs[key] = true
+	go func() {
+		work, err := generateWork(context.Background(), root, difficulty, priorityPrecompute)
+		if err == nil {
+			err = store.setCachedWork(root, work)
+		}
+		if err != nil {
+			log.Print(err)
+		}
+		c.m.Lock()
+		delete(c.jobs, key)
+		c.m.Unlock()
+	}()
+}
+
+func precomputeWork(address string, frontier rpc.BlockHash, balance *big.Int) {
+	if frontier == nil {
+		pubkey, err := util.AddressToPubkey(address)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		works.precompute(pubkey, receiveDifficulty)
+	} else if balance.Sign() > 0 {
+		works.precompute(frontier, sendDifficulty)
+	} else {
+		works.precompute(frontier, receiveDifficulty)
+	}
+}
+
+func precomputeAccountWork(address string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	client := stickyClient(ctx, address)
+	ai, err := client.AccountInfo(address)
+	if err != nil {
+		if err.Error() == "Account not found" {
+			precomputeWork(address, nil, nil)
+		} else {
+			log.Print(err)
+		}
+		return
+	}
+	precomputeWork(address, ai.Frontier, &ai.Balance.Int)
+}
+
+type workPeer struct {
+	url      string
+	m        sync.Mutex
+	failures uint
+	until    time.Time
+}
+
+func (p *workPeer) healthy() bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return time.Now().After(p.until)
+}
+
+func (p *workPeer) fail() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	backoff := time.Second << p.failures
+	if backoff > 5*time.Minute {
+		backoff = 5 * time.Minute
+	} else {
+		p.failures++
+	}
+	p.until = time.Now().Add(backoff)
+}
+
+func (p *workPeer) succeed() {
+	p.m.Lock()
+	p.failures = 0
+	p.until = time.Time{}
+	p.m.Unlock()
+}
+
+func (p *workPeer) cancel(root rpc.BlockHash) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := rpc.Client{URL: p.url, Ctx: ctx}
+	client.WorkCancel(root)
+}
+
+func initWorkPeers() {
+	for _, url := range strings.Split(*powURL, ",") {
+		switch url = strings.TrimSpace(url); url {
+		case "":
+		case "node":
+			for _, n := range nodes.nodes {
+				workPeers = append(workPeers, &workPeer{url: n.url})
+			}
+		default:
+			workPeers = append(workPeers, &workPeer{url: url})
+		}
+	}
+}
+
+func generateWork(
+	ctx context.Context, root rpc.BlockHash, difficulty []byte, priority int,
+) (work rpc.HexData, err error) {
+	var peers []*workPeer
+	for _, p := range workPeers {
+		if p.healthy() {
+			peers = append(peers, p)
+		}
+	}
+	if len(peers) > 0 {
+		if work, err = raceWorkPeers(ctx, peers, root, difficulty); err == nil {
+			return
+		}
+		log.Print(err)
+	} else if len(workPeers) > 0 {
+		err = errors.New("no healthy work peers")
+	}
+	if !*powCPU && len(workPeers) > 0 {
+		return
+	}
+	return cpuEngine.generate(ctx, root, difficulty, priority)
+}
+
+func raceWorkPeers(
+	ctx context.Context, peers []*workPeer, root rpc.BlockHash, difficulty []byte,
+) (work rpc.HexData, err error) {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, *powTimeout)
+	defer cancel()
+	type result struct {
+		peer *workPeer
+		work rpc.HexData
+		err  error
+	}
+	ch := make(chan result, len(peers))
+	for _, p := range peers {
+		go func(p *workPeer) {
+			client := rpc.Client{URL: p.url, Ctx: ctx}
+			work, _, _, err := client.WorkGenerate(root, difficulty)
+			if err == nil && !validateWork(root, work, difficulty) {
+				err = errors.New("invalid work from " + p.url)
+			}
+			ch <- result{p, work, err}
+		}(p)
+	}
+	for range peers {
+		r := <-ch
+		if r.err == nil {
+			r.peer.succeed()
+			for _, p := range peers {
+				if p != r.peer {
+					go p.cancel(root)
+				}
+			}
+			return r.work, nil
+		}
+		// A peer is only backed off for its own errors and timeouts, not
+		// because the caller gave up on the work.
+		if parent.Err() != nil {
+			return nil, parent.Err()
+		}
+		r.peer.fail()
+		err = r.err
+	}
+	return
+}
@@ -1,81 +1,220 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"log"
 	"sync"
+	"time"
 
-	"github.com/hectorchu/gonano/websocket"
+	"github.com/gorilla/websocket"
+	nanows "github.com/hectorchu/gonano/websocket"
 )
 
 type wsMux struct {
-	url string
-	m   sync.Mutex
-	c   *websocket.Client
-	ch  map[string]chan<- interface{}
+	m        sync.Mutex
+	running  bool
+	c        *websocket.Conn
+	url      string
+	filtered bool
+	seen     map[string]bool
+	subs     subscriptions
 }
 
-func newWSMux(url string) *wsMux {
-	return &wsMux{
-		url: url,
-		ch:  make(map[string]chan<- interface{}),
-	}
+func newWSMux() *wsMux {
+	return &wsMux{subs: make(subscriptions)}
 }
 
-func (ws *wsMux) connect(account string) (msg <-chan interface{}, err error) {
+func (ws *wsMux) connect(account string) (sub *subscription, err error) {
 	ws.m.Lock()
 	defer ws.m.Unlock()
-	if ws.c == nil {
-		c := &websocket.Client{URL: ws.url}
-		if err = c.Connect(); err != nil {
-			return
-		}
-		ws.c = c
-		go ws.loop()
+	sub = newSubscription(account)
+	if ws.subs.add(sub) {
+		ws.update("accounts_add", account)
 	}
-	ch := make(chan interface{}, 32)
-	ws.ch[account] = ch
-	return ch, nil
+	if !ws.running {
+		ws.running = true
+		go ws.run()
+		go ws.sweep()
+	}
+	return
 }
 
-func (ws *wsMux) disconnect(account string) {
+func (ws *wsMux) disconnect(sub *subscription) {
 	ws.m.Lock()
-	delete(ws.ch, account)
+	if ws.subs.remove(sub) {
+		ws.update("accounts_del", sub.account)
+	}
 	ws.m.Unlock()
 }
 
-func (ws *wsMux) loop() {
-	for {
-		switch m := (<-ws.c.Messages).(type) {
-		case *websocket.Confirmation:
+// dial connects to the first reachable node and subscribes to the watched
+// accounts. The lock is only taken to read the accounts and to swap in the
+// connection, so a slow node does not hold up subscribers.
+func (ws *wsMux) dial() (err error) {
+	ws.m.Lock()
+	accounts := ws.subs.accounts()
+	ws.m.Unlock()
+	var (
+		c   *websocket.Conn
+		url string
+	)
+	for _, url = range nodes.wsURLs() {
+		if c, _, err = websocket.DefaultDialer.Dial(url, nil); err == nil {
+			break
+		}
+	}
+	if c == nil {
+		if err == nil {
+			err = errors.New("no websocket URLs")
+		}
+		return
+	}
+	if err = c.WriteJSON(map[string]interface{}{
+		"action":  "subscribe",
+		"topic":   "confirmation",
+		"ack":     true,
+		"options": map[string]interface{}{"accounts": accounts},
+	}); err != nil {
+		c.Close()
+		return
+	}
+	ws.m.Lock()
+	defer ws.m.Unlock()
+	ws.c, ws.url, ws.filtered = c, url, true
+	ws.seen = make(map[string]bool)
+	for _, account := range accounts {
+		ws.seen[account] = true
+	}
+	for _, account := range ws.subs.accounts() {
+		if !ws.seen[account] {
+			ws.update("accounts_add", account)
+		}
+	}
+	return
+}
+
+func (ws *wsMux) update(action, account string) {
+	if ws.c == nil || !ws.filtered {
+		return
+	}
+	if action == "accounts_add" {
+		ws.seen[account] = true
+	}
+	if err := ws.c.WriteJSON(map[string]interface{}{
+		"action":  "update",
+		"topic":   "confirmation",
+		"options": map[string]interface{}{action: []string{account}},
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
+func (ws *wsMux) unfilter() {
+	log.Print("node does not support confirmation filtering, using the full stream")
+	ws.filtered = false
+	if err := ws.c.WriteJSON(map[string]string{
+		"action": "subscribe",
+		"topic":  "confirmation",
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
+func (ws *wsMux) run() {
+	for backoff := time.Second; ; {
+		if err := ws.dial(); err != nil {
+			log.Print(err)
+		} else {
+			backoff = time.Second
+			go ws.catchUp()
+			log.Print(ws.loop())
 			ws.m.Lock()
-			if ch, ok := ws.ch[m.Block.Account]; ok {
-				ws.send(ch, m)
-			}
-			if m.Block.Account != m.Block.LinkAsAccount {
-				if ch, ok := ws.ch[m.Block.LinkAsAccount]; ok {
-					ws.send(ch, m)
-				}
-			}
+			ws.c.Close()
+			ws.c = nil
 			ws.m.Unlock()
-		case error:
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+func (ws *wsMux) loop() error {
+	ws.m.Lock()
+	c, url := ws.c, ws.url
+	ws.m.Unlock()
+	for {
+		var v struct {
+			Topic   string
+			Time    int64 `json:",string"`
+			Error   string
+			Message json.RawMessage
+		}
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			return err
+		}
+		traffic.WS(url, data)
+		if err = json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		if v.Error != "" {
 			ws.m.Lock()
-			for _, ch := range ws.ch {
-				ws.send(ch, m)
+			if ws.filtered {
+				ws.unfilter()
 			}
-			ws.c.Close()
-			ws.c = nil
 			ws.m.Unlock()
-			return
+			continue
+		}
+		if v.Topic != "confirmation" {
+			continue
 		}
+		var m nanows.Confirmation
+		if err := json.Unmarshal(v.Message, &m); err != nil {
+			return err
+		}
+		if m.Block == nil {
+			continue
+		}
+		m.Time = time.Unix(0, v.Time*1e6).UTC()
+		ws.m.Lock()
+		if ws.filtered && !ws.seen[m.Block.Account] && !ws.seen[m.Block.LinkAsAccount] {
+			ws.unfilter()
+		}
+		ws.m.Unlock()
+		ws.dispatch(&m)
+	}
+}
+
+func (ws *wsMux) dispatch(m *nanows.Confirmation) {
+	ws.m.Lock()
+	ws.subs.dispatch(m)
+	ws.m.Unlock()
+}
+
+// sweep periodically reconciles subscribers with the ledger, in case the
+// node dropped a confirmation.
+func (ws *wsMux) sweep() {
+	for range time.Tick(30 * time.Second) {
+		ws.catchUp()
 	}
 }
 
-func (ws *wsMux) send(ch chan<- interface{}, m interface{}) {
-	switch len(ch) {
-	case cap(ch):
-	case cap(ch) - 1:
-		ch <- errors.New("channel buffer full")
-	default:
-		ch <- m
+func (ws *wsMux) catchUp() {
+	ws.m.Lock()
+	accounts := ws.subs.accounts()
+	ws.m.Unlock()
+	if len(accounts) == 0 {
+		return
+	}
+	events, err := ledgerEvents(nodeClient(context.Background()), accounts)
+	if err != nil {
+		log.Print(err)
+	}
+	for _, m := range events {
+		ws.dispatch(m)
 	}
 }